@@ -4,41 +4,124 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/densify-quick-start/helm-optimize-resources/support"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	densifyURL  string
-	densifyUser string
-	densifyPass string
-	analysisId  string
-	analysisEP  = "/CIRBA/api/v2/analysis/containers/kubernetes"
-	authorizeEP = "/CIRBA/api/v2/authorize"
-	systemsEP   = "/CIRBA/api/v2/systems"
+	densifyURL       string
+	densifyUser      string
+	densifyPass      string
+	densifyAPIKey    string
+	densifyToken     string
+	tokenExpiry      time.Time
+	credentialSource string
+	analysis         string
+	nsAnalyses       map[string]string
+	rules            = []string{"controllerType", "newest", "max"}
+	deployAttr       = "Deployment Status"
+	analysisEP       = "/CIRBA/api/v2/analysis/containers/kubernetes"
+	authorizeEP      = "/CIRBA/api/v2/authorize"
+	systemsEP        = "/CIRBA/api/v2/systems"
 )
 
+//ApprovalSettings holds the approval settings that can be selected in densify
+var ApprovalSettings = []string{"Not Approved", "Approve Specific Change", "Approve Any Change"}
+
+//analyses holds the analyses available in densify, analysisIds the analysisId resolved for each selector
+var analyses []map[string]interface{}
+var analysisIds = make(map[string]string)
+
+//insightCache holds the analysis results fetched for each cluster/namespace
+var insightCache = make(map[string][]Insight)
+
+//attributeCache holds the attributes fetched for each entityId
+var attributeCache = make(map[string]map[string]string)
+
+//attributeWorkers is the number of entities whose attributes are fetched concurrently
+const attributeWorkers = 8
+
+//tokenLock serializes the validation and refresh of the densify token across concurrent requests
+var tokenLock sync.Mutex
+
+//Recommendation holds the resolved recommendation of a container, with its specs as k8s quantities.  Current is nil when densify does not report a complete current spec.
+type Recommendation struct {
+	Namespace       string
+	ObjType         string
+	ObjName         string
+	Container       string
+	Current         map[string]map[string]string
+	Recommended     map[string]map[string]string
+	ApprovalSetting string
+}
+
+//Insight this struct holds a recommendation
+type Insight struct {
+	Container       string  `json:"container"`
+	RecommFirstSeen int64   `json:"recommFirstSeen"`
+	Cluster         string  `json:"cluster"`
+	HostName        string  `json:"hostName,omitempty"`
+	PredictedUptime float64 `json:"predictedUptime,omitempty"`
+	ControllerType  string  `json:"controllerType"`
+	DisplayName     string  `json:"displayName"`
+	RecommLastSeen  int64   `json:"recommLastSeen"`
+	EntityID        string  `json:"entityId"`
+	PodService      string  `json:"podService"`
+	AuditInfo       struct {
+		DataCollection struct {
+			DateFirstAudited int64 `json:"dateFirstAudited"`
+			AuditCount       int   `json:"auditCount"`
+			DateLastAudited  int64 `json:"dateLastAudited"`
+		} `json:"dataCollection"`
+		WorkloadDataLast30 struct {
+			TotalDays int   `json:"totalDays"`
+			SeenDays  int   `json:"seenDays"`
+			FirstDate int64 `json:"firstDate"`
+			LastDate  int64 `json:"lastDate"`
+		} `json:"workloadDataLast30"`
+	} `json:"auditInfo,omitempty"`
+	RecommendedCPULimit   float64 `json:"recommendedCpuLimit,omitempty"`
+	RecommendedMemRequest float64 `json:"recommendedMemRequest,omitempty"`
+	CurrentCount          int     `json:"currentCount"`
+	RecommSeenCount       int     `json:"recommSeenCount"`
+	Namespace             string  `json:"namespace"`
+	RecommendedMemLimit   float64 `json:"recommendedMemLimit,omitempty"`
+	RecommendationType    string  `json:"recommendationType"`
+	RecommendedCPURequest float64 `json:"recommendedCpuRequest,omitempty"`
+	CurrentMemLimit       float64 `json:"currentMemLimit,omitempty"`
+	CurrentMemRequest     float64 `json:"currentMemRequest,omitempty"`
+	CurrentCPULimit       float64 `json:"currentCpuLimit,omitempty"`
+	CurrentCPURequest     float64 `json:"currentCpuRequest,omitempty"`
+
+	//combined holds the results aggregated into this one by the max rule
+	combined []Insight
+}
+
 ////////////////////////////////////////////////////////
 ////////////////EXTERNAL FUNCTIONS//////////////////////
 ////////////////////////////////////////////////////////
 
-//Initialize will initilize the densify secrets k8s object, if it doesn't exist in the current-context.
-func Initialize() error {
+//Initialize will initilize the densify secrets k8s object, if it doesn't exist in the current-context (or reconfigure is set).
+func Initialize(reconfigure bool) error {
 
 	//check stored secret
 	storedSecrets := support.RetrieveSecrets("helm-optimize-plugin")
-	if storedSecrets != nil && storedSecrets["adapter"] == "Densify" {
-		if _, ok := storedSecrets["densifyURL"]; ok {
-			densifyURL = storedSecrets["densifyURL"]
-			densifyUser = storedSecrets["densifyUser"]
-			densifyPass = storedSecrets["densifyPass"]
-
-			if err := validateSecrets(); err == nil {
-				return nil
-			}
+	if !reconfigure && storedSecrets != nil && storedSecrets["adapter"] == "Densify" {
+		//a failing credential source is reported rather than replaced by prompts, it is replaced by reconfiguring the adapter
+		if err := loadSecrets(storedSecrets); err == nil {
+			return nil
+		} else if storedSecrets["densifyCredentialSource"] != "" {
+			return errors.New(err.Error() + " - fix the credential source, or replace it with 'helm optimize -c --adapter'")
+		} else if !terminal.IsTerminal(0) {
+			//the password is never stored, so an expired password login can only be renewed at a terminal
+			return errors.New(err.Error() + " - password logins are interactive only, configure an API key or a credential source with 'helm optimize -c --adapter' for unattended runs")
 		}
 	}
 
@@ -83,23 +166,148 @@ func Initialize() error {
 		densifyURL = strings.TrimSuffix(densifyURL, "/")
 	}
 
-	fmt.Print("Enter Densify Username: ")
-	fmt.Scanln(&densifyUser)
+	var authMethod string
+	fmt.Print("Authenticate with (1) username/password, (2) API key or (3) credential helper, environment variable or file [1]: ")
+	fmt.Scanln(&authMethod)
+
+	densifyToken, densifyAPIKey, densifyPass, tokenExpiry, credentialSource = "", "", "", time.Time{}, ""
+	if authMethod == "3" {
+		for {
+			fmt.Print("Enter credential source (helper:<command> [args], env:<VAR> or file:<path>): ")
+			credentialSource = support.ReadLine()
+			if err := support.ValidateCredentialSource(credentialSource); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			break
+		}
+
+		densifyUser = ""
+		fmt.Print("Enter Densify Username (leave blank if the source provides an API key): ")
+		fmt.Scanln(&densifyUser)
+
+		if err := resolveCredential(); err != nil {
+			return err
+		}
+	} else if authMethod == "2" {
+		fmt.Print("Enter Densify API Key: ")
+		key, _ := terminal.ReadPassword(0)
+		densifyAPIKey = string(key)
+		fmt.Println("")
+	} else {
+		fmt.Print("Enter Densify Username: ")
+		fmt.Scanln(&densifyUser)
 
-	fmt.Print("Enter Densify Password: ")
-	pass, _ := terminal.ReadPassword(0)
-	densifyPass = string(pass)
-	fmt.Println("")
+		fmt.Print("Enter Densify Password: ")
+		pass, _ := terminal.ReadPassword(0)
+		densifyPass = string(pass)
+		fmt.Println("")
+	}
 
 	if err := validateSecrets(); err != nil {
-		support.RemoveSecretData("helm-optimize-plugin", "densifyURL")
-		support.RemoveSecretData("helm-optimize-plugin", "densifyUser")
-		support.RemoveSecretData("helm-optimize-plugin", "densifyPass")
+		support.UpdateSecrets("helm-optimize-plugin", nil, []string{"densifyURL", "densifyUser", "densifyPass", "densifyAPIKey", "densifyToken", "densifyTokenExpiry", "densifyCredentialSource"})
 		return err
 	}
 
 	storeSecrets()
 
+	//the analysis settings are kept across logins, and only prompted for with -c --analysis
+	if _, ok := storedSecrets["densifyAnalysis"]; !ok {
+		fmt.Println("Using the analysis matching the remote cluster - use 'helm optimize -c --analysis' to select another analysis")
+	}
+
+	return nil
+
+}
+
+//Load readies the adapter from the stored secret without prompting, even if densify is not the selected adapter (eg. to sync densify into another repository).
+//A password login is refused, as its token can only be renewed (and stored) interactively while densify is the selected adapter.
+func Load() error {
+
+	storedSecrets := support.RetrieveSecrets("helm-optimize-plugin")
+	if storedSecrets == nil {
+		return errors.New("densify is not configured - select the Densify adapter with helm optimize -c --adapter")
+	}
+	if storedSecrets["densifyAPIKey"] == "" && storedSecrets["densifyCredentialSource"] == "" {
+		return errors.New("densify must be configured with an API key or a credential source - configure one with helm optimize -c --adapter (or set HELM_OPTIMIZE_DENSIFY_CREDENTIAL_SOURCE)")
+	}
+
+	return loadSecrets(storedSecrets)
+
+}
+
+//ConfigureAnalysis lets the user select the densify analysis used for lookups, either globally or per namespace.
+func ConfigureAnalysis() error {
+
+	if err := loadAnalyses(); err != nil {
+		return err
+	}
+
+	fmt.Println("Available Analyses")
+	fmt.Println("  0. <match analysis name to the remote cluster>")
+	for i, val := range analyses {
+		fmt.Println("  " + strconv.Itoa(i+1) + ". " + fmt.Sprint(val["analysisName"]) + " [" + fmt.Sprint(val["analysisId"]) + "]")
+	}
+
+	analysis = selectAnalysis("Default analysis [0]: ")
+
+	//existing namespace mappings are kept unless remapped (or removed by selecting 0)
+	if nsAnalyses == nil {
+		nsAnalyses = make(map[string]string)
+	}
+	for ns, selected := range nsAnalyses {
+		fmt.Println("  mapped: " + ns + "=" + selected)
+	}
+	for {
+		var ns string
+		fmt.Print("Namespace to map to a different analysis [done]: ")
+		fmt.Scanln(&ns)
+		if ns == "" {
+			break
+		}
+		if selected := selectAnalysis("Analysis for namespace " + ns + " (0 removes the mapping): "); selected != "" {
+			nsAnalyses[ns] = selected
+		} else {
+			delete(nsAnalyses, ns)
+		}
+	}
+
+	var mappings []string
+	for ns, selected := range nsAnalyses {
+		mappings = append(mappings, ns+"="+selected)
+	}
+
+	//rules used when densify returns multiple results for one container
+	for {
+		var ruleList string
+		fmt.Print("Rules to resolve multiple results, applied in order [" + strings.Join(rules, ",") + "]: ")
+		fmt.Scanln(&ruleList)
+		if ruleList == "" {
+			break
+		}
+		valid := true
+		for _, rule := range strings.Split(ruleList, ",") {
+			if _, ok := support.InSlice([]string{"controllerType", "newest", "max"}, rule); !ok {
+				fmt.Println("Invalid rule [" + rule + "].  Choose from controllerType, newest and max.")
+				valid = false
+			}
+		}
+		if valid {
+			rules = strings.Split(ruleList, ",")
+			break
+		}
+	}
+
+	//attribute used to record which recommendations were deployed
+	var attr string
+	fmt.Print("Attribute used to record deployments [" + deployAttr + "]: ")
+	fmt.Scanln(&attr)
+	if attr != "" {
+		deployAttr = attr
+	}
+
+	support.StoreSecrets("helm-optimize-plugin", map[string]string{"densifyAnalysis": analysis, "densifyNamespaceAnalyses": strings.Join(mappings, ","), "densifyDisambiguation": strings.Join(rules, ","), "densifyDeployAttribute": deployAttr})
+
 	return nil
 
 }
@@ -107,79 +315,223 @@ func Initialize() error {
 //GetInsight gets an insight from densify based on the keys cluster, namespace, objType, objName and containerName
 func GetInsight(cluster string, namespace string, objType string, objName string, containerName string) (map[string]map[string]string, string, error) {
 
-	insight, err := lookupInsight(cluster, namespace, objType, objName, containerName)
+	insight, _, err := lookupInsight(cluster, namespace, objType, objName, containerName)
 	if err != nil {
 		return nil, "", errors.New("unable to locate resource spec")
 	}
 
-	var insightObj = map[string]map[string]string{}
-	insightObj["limits"] = map[string]string{}
-	insightObj["requests"] = map[string]string{}
+	approvalSetting, _ := effectiveApprovalSetting(insight)
+
+	var insightObj map[string]map[string]string
+	if approvalSetting != "Not Approved" {
+		insightObj = quantities(insight.RecommendedCPULimit, insight.RecommendedMemLimit, insight.RecommendedCPURequest, insight.RecommendedMemRequest)
+	} else {
+		insightObj = quantities(insight.CurrentCPULimit, insight.CurrentMemLimit, insight.CurrentCPURequest, insight.CurrentMemRequest)
+	}
+
+	if insightObj == nil {
+		return nil, "", errors.New("invalid resource specs received from repository")
+	}
+
+	return insightObj, approvalSetting, nil
+
+}
+
+//Recommendations gets the recommendation of every container of the cluster, from the analyses selected for the cluster and its namespaces.
+//Multiple results for a container are resolved with the disambiguation rules, the containers that can't be resolved (or have no valid
+//recommended spec) are returned separately with the reason.
+func Recommendations(cluster string) ([]Recommendation, []string, error) {
 
-	approvalSetting, err := getAttribute(insight["entityId"].(string), "attr_ApprovalSetting")
+	//the default analysis covers every namespace that is not mapped to another analysis
+	analysisId, err := resolveAnalysis(cluster, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	clusterInsights, err := fetchInsights(analysisId, cluster, "")
 	if err != nil {
-		approvalSetting = "Not Approved"
+		return nil, nil, err
 	}
 
-	if approvalSetting != "Not Approved" && support.InMap(insight, []string{"recommendedCpuLimit", "recommendedMemLimit", "recommendedCpuRequest", "recommendedMemRequest"}) && insight["recommendedCpuLimit"].(float64) > 0 && insight["recommendedMemLimit"].(float64) > 0 && insight["recommendedCpuRequest"].(float64) > 0 && insight["recommendedMemRequest"].(float64) > 0 {
+	var insights []Insight
+	for _, insight := range clusterInsights {
+		if _, ok := nsAnalyses[insight.Namespace]; !ok {
+			insights = append(insights, insight)
+		}
+	}
 
-		approvalSetting = "Approved"
+	for namespace := range nsAnalyses {
+		analysisId, err := resolveAnalysis(cluster, namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		nsInsights, err := fetchInsights(analysisId, cluster, namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		insights = append(insights, nsInsights...)
+	}
 
-		insightObj["limits"]["cpu"] = strconv.FormatFloat(insight["recommendedCpuLimit"].(float64), 'f', -1, 64) + "m"
-		insightObj["limits"]["memory"] = strconv.FormatFloat(insight["recommendedMemLimit"].(float64), 'f', -1, 64) + "Mi"
-		insightObj["requests"]["cpu"] = strconv.FormatFloat(insight["recommendedCpuRequest"].(float64), 'f', -1, 64) + "m"
-		insightObj["requests"]["memory"] = strconv.FormatFloat(insight["recommendedMemRequest"].(float64), 'f', -1, 64) + "Mi"
+	//group the results by container
+	var keys []string
+	groups := make(map[string][]Insight)
+	for _, insight := range insights {
+		key := insight.Namespace + "/" + insight.ControllerType + "/" + insight.PodService + "/" + insight.Container
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], insight)
+	}
 
-	} else if approvalSetting == "Not Approved" && support.InMap(insight, []string{"currentCpuLimit", "currentMemLimit", "currentCpuRequest", "currentMemRequest"}) && insight["currentCpuLimit"].(float64) > 0 && insight["currentMemLimit"].(float64) > 0 && insight["currentCpuRequest"].(float64) > 0 && insight["currentMemRequest"].(float64) > 0 {
+	var recommendations []Recommendation
+	var unresolved []string
+	for _, key := range keys {
 
-		insightObj["limits"]["cpu"] = strconv.FormatFloat(insight["currentCpuLimit"].(float64), 'f', -1, 64) + "m"
-		insightObj["limits"]["memory"] = strconv.FormatFloat(insight["currentMemLimit"].(float64), 'f', -1, 64) + "Mi"
-		insightObj["requests"]["cpu"] = strconv.FormatFloat(insight["currentCpuRequest"].(float64), 'f', -1, 64) + "m"
-		insightObj["requests"]["memory"] = strconv.FormatFloat(insight["currentMemRequest"].(float64), 'f', -1, 64) + "Mi"
+		insight, _, err := disambiguate(groups[key], groups[key][0].ControllerType)
+		if err != nil {
+			unresolved = append(unresolved, key+": "+strconv.Itoa(len(groups[key]))+" results not resolved by the disambiguation rules")
+			continue
+		}
 
-	} else {
+		recommended := quantities(insight.RecommendedCPULimit, insight.RecommendedMemLimit, insight.RecommendedCPURequest, insight.RecommendedMemRequest)
+		if recommended == nil {
+			unresolved = append(unresolved, key+": invalid recommended spec")
+			continue
+		}
 
-		return nil, "", errors.New("invalid resource specs received from repository")
+		approvalSetting, _ := effectiveApprovalSetting(insight)
+		recommendations = append(recommendations, Recommendation{
+			Namespace:       insight.Namespace,
+			ObjType:         insight.ControllerType,
+			ObjName:         insight.PodService,
+			Container:       insight.Container,
+			Current:         quantities(insight.CurrentCPULimit, insight.CurrentMemLimit, insight.CurrentCPURequest, insight.CurrentMemRequest),
+			Recommended:     recommended,
+			ApprovalSetting: approvalSetting,
+		})
 
 	}
 
-	return insightObj, approvalSetting, nil
+	return recommendations, unresolved, nil
 
 }
 
-//UpdateApprovalSetting this will update the approval status for a specific recommendation
-func UpdateApprovalSetting(approved bool, cluster string, namespace string, objType string, objName string, containerName string) error {
+//GetPodInsight gets a pod-level insight from densify.  Densify analyzes containers individually, so pod-level insights are not available.
+func GetPodInsight(cluster string, namespace string, objType string, objName string) (map[string]map[string]string, string, error) {
+	return nil, "", errors.New("pod-level insights not supported by adapter")
+}
 
-	insight, err := lookupInsight(cluster, namespace, objType, objName, containerName)
+//GetInsightMeta gets the audit metadata of an insight from densify
+func GetInsightMeta(cluster string, namespace string, objType string, objName string, containerName string) (support.InsightMeta, error) {
+
+	insight, resolution, err := lookupInsight(cluster, namespace, objType, objName, containerName)
+	if err != nil {
+		return support.InsightMeta{}, errors.New("unable to locate resource spec")
+	}
+
+	return support.InsightMeta{
+		FirstSeen:  time.Unix(0, insight.RecommFirstSeen*int64(time.Millisecond)),
+		LastSeen:   time.Unix(0, insight.RecommLastSeen*int64(time.Millisecond)),
+		SeenCount:  insight.RecommSeenCount,
+		DataDays:   insight.AuditInfo.WorkloadDataLast30.SeenDays,
+		Resolution: resolution,
+	}, nil
+
+}
+
+//UpdateApprovalSetting this will update the approval status for a specific recommendation.
+//A non-zero effective date schedules the approval, it is not honoured before that date.
+func UpdateApprovalSetting(approvalSetting string, effective time.Time, cluster string, namespace string, objType string, objName string, containerName string) error {
+
+	if _, ok := support.InSlice(ApprovalSettings, approvalSetting); !ok {
+		return errors.New("unsupported approval setting [" + approvalSetting + "]")
+	}
+
+	insight, _, err := lookupInsight(cluster, namespace, objType, objName, containerName)
 	if err != nil {
 		return errors.New("unable to update approval setting")
 	}
 
-	if approved == true {
-		_, err = support.HTTPRequest("PUT", densifyURL+systemsEP+"/"+insight["entityId"].(string)+"/attributes", densifyUser+":"+densifyPass, []byte("[{\"name\": \"Approval Setting\", \"value\": \"Approve Specific Change\"}]"))
-	} else {
-		_, err = support.HTTPRequest("PUT", densifyURL+systemsEP+"/"+insight["entityId"].(string)+"/attributes", densifyUser+":"+densifyPass, []byte("[{\"name\": \"Approval Setting\", \"value\": \"Not Approved\"}]"))
+	//an aggregated result is approved on every combined entity, each against its own recommendation
+	for _, entity := range entities(insight) {
+
+		attributes := approvalAttributes(entity, approvalSetting, effective)
+		jsonReq, err := json.Marshal(attributes)
+		if err != nil {
+			return err
+		}
+
+		_, err = request("PUT", systemsEP+"/"+entity.EntityID+"/attributes", jsonReq)
+
+		//the optional attributes may not be defined in densify, so fall back to the approval setting alone where that keeps its meaning
+		if err != nil && len(attributes) > 1 {
+			if approvalSetting != "Not Approved" && !effective.IsZero() {
+				return errors.New("unable to schedule the approval - is the 'Approval Effective Date' attribute defined in densify? " + err.Error())
+			}
+			if approvalSetting == "Approve Specific Change" {
+				fmt.Println("  'Approved Recommendation' attribute not set - the approval of " + entity.EntityID + " will not expire when the recommendation changes")
+			}
+			jsonReq, _ = json.Marshal(attributes[:1])
+			_, err = request("PUT", systemsEP+"/"+entity.EntityID+"/attributes", jsonReq)
+		}
+
+		//the cached attributes are stale once updated
+		delete(attributeCache, entity.EntityID)
+
+		if err != nil {
+			return err
+		}
+
 	}
 
-	return err
+	return nil
 
 }
 
-//GetApprovalSetting this will update the approval status for a specific recommendation
-func GetApprovalSetting(cluster string, namespace string, objType string, objName string, containerName string) (string, error) {
+//RecordDeployment records on the densify system that its recommendation was implemented by a helm release.
+//The deviations are the deployed quantities that differ from the recommendation, a recommendation deployed with deviations is recorded as partially implemented.
+func RecordDeployment(cluster string, namespace string, objType string, objName string, containerName string, release string, revision string, deployedAt time.Time, deviations string) error {
 
-	insight, err := lookupInsight(cluster, namespace, objType, objName, containerName)
+	insight, _, err := lookupInsight(cluster, namespace, objType, objName, containerName)
 	if err != nil {
-		return "", errors.New("unable to get approval setting")
+		return errors.New("unable to record deployment")
+	}
+
+	status := "Implemented by release " + release + " revision " + revision + " at " + deployedAt.UTC().Format(time.RFC3339)
+	if deviations != "" {
+		status = "Partially implemented by release " + release + " revision " + revision + " at " + deployedAt.UTC().Format(time.RFC3339) + " - deployed " + deviations
 	}
 
-	approvalSetting, err := getAttribute(insight["entityId"].(string), "attr_ApprovalSetting")
+	jsonReq, err := json.Marshal([]map[string]string{{
+		"name":  deployAttr,
+		"value": status,
+	}})
 	if err != nil {
-		approvalSetting = "Not Approved"
+		return err
 	}
 
-	if approvalSetting != "Not Approved" {
-		approvalSetting = "Approved"
+	//the deployment of an aggregated result is recorded on every combined entity
+	for _, entity := range entities(insight) {
+		if _, err := request("PUT", systemsEP+"/"+entity.EntityID+"/attributes", jsonReq); err != nil {
+			return errors.New("unable to record deployment: " + err.Error())
+		}
+		delete(attributeCache, entity.EntityID)
+	}
+
+	return nil
+
+}
+
+//GetApprovalSetting this will update the approval status for a specific recommendation
+func GetApprovalSetting(cluster string, namespace string, objType string, objName string, containerName string) (string, error) {
+
+	insight, _, err := lookupInsight(cluster, namespace, objType, objName, containerName)
+	if err != nil {
+		return "", errors.New("unable to get approval setting")
+	}
+
+	approvalSetting, reason := effectiveApprovalSetting(insight)
+	if reason != "" {
+		approvalSetting += " (" + reason + ")"
 	}
 
 	return approvalSetting, nil
@@ -190,72 +542,522 @@ func GetApprovalSetting(cluster string, namespace string, objType string, objNam
 ///////////////////LOCAL FUNCTIONS//////////////////////
 ////////////////////////////////////////////////////////
 
-func lookupInsight(cluster string, namespace string, objType string, objName string, containerName string) (map[string]interface{}, error) {
+func lookupInsight(cluster string, namespace string, objType string, objName string, containerName string) (Insight, string, error) {
 
-	//locate analysisId if not yet located.
-	if analysisId == "" {
+	analysisId, err := resolveAnalysis(cluster, namespace)
+	if err != nil {
+		return Insight{}, "", err
+	}
 
-		resp, err := support.HTTPRequest("GET", densifyURL+analysisEP, densifyUser+":"+densifyPass, nil)
-		if err != nil {
-			return nil, errors.New("unable to load analysis")
+	insights, err := fetchInsights(analysisId, cluster, namespace)
+	if err != nil {
+		return Insight{}, "", err
+	}
+
+	var matches []Insight
+	for _, insight := range insights {
+		if insight.Namespace == namespace && insight.PodService == objName && insight.Container == containerName {
+			matches = append(matches, insight)
+		}
+	}
+
+	if len(matches) == 1 && matches[0].ControllerType == objType {
+		return matches[0], "", nil
+	}
+
+	return disambiguate(matches, objType)
+
+}
+
+//fetchInsights fetches all results of an analysis for the cluster (and namespace if specified) once, and serves the remaining lookups from memory
+func fetchInsights(analysisId string, cluster string, namespace string) ([]Insight, error) {
+
+	cacheKey := analysisId + "/" + cluster + "/" + namespace
+	if insights, ok := insightCache[cacheKey]; ok {
+		return insights, nil
+	}
+
+	query := "?cluster=" + url.QueryEscape(cluster)
+	if namespace != "" {
+		query += "&namespace=" + url.QueryEscape(namespace)
+	}
+
+	resp, err := request("GET", analysisEP+"/"+analysisId+"/results"+query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var insights []Insight
+	if err := json.Unmarshal([]byte(resp), &insights); err != nil {
+		return nil, errors.New("unable to parse analysis results")
+	}
+	insightCache[cacheKey] = insights
+	prefetchAttributes(insights)
+
+	return insights, nil
+
+}
+
+//prefetchAttributes fetches the attributes of every entity in the results that are not cached yet.
+//The systems endpoint only serves the attributes of one entity per request, so the requests are issued concurrently rather than as each entity is looked up.
+//Entities that fail are left uncached, and are retried (and reported) when their attributes are looked up.
+func prefetchAttributes(insights []Insight) {
+
+	var entityIDs []string
+	seen := make(map[string]bool)
+	for _, insight := range insights {
+		if _, ok := attributeCache[insight.EntityID]; !ok && insight.EntityID != "" && !seen[insight.EntityID] {
+			entityIDs = append(entityIDs, insight.EntityID)
+			seen[insight.EntityID] = true
+		}
+	}
+
+	type fetched struct {
+		entityID   string
+		attributes map[string]string
+		err        error
+	}
+	queue := make(chan string, len(entityIDs))
+	results := make(chan fetched, len(entityIDs))
+	for _, entityID := range entityIDs {
+		queue <- entityID
+	}
+	close(queue)
+	for i := 0; i < attributeWorkers && i < len(entityIDs); i++ {
+		go func() {
+			for entityID := range queue {
+				attributes, err := fetchAttributes(entityID)
+				results <- fetched{entityID, attributes, err}
+			}
+		}()
+	}
+
+	for range entityIDs {
+		if result := <-results; result.err == nil {
+			attributeCache[result.entityID] = result.attributes
 		}
+	}
+
+}
 
-		var analyses []interface{}
-		json.Unmarshal([]byte(resp), &analyses)
+func disambiguate(matches []Insight, objType string) (Insight, string, error) {
 
-		found := false
-		for _, analysis := range analyses {
-			if analysis.(map[string]interface{})["analysisName"].(string) == cluster {
-				analysisId = analysis.(map[string]interface{})["analysisId"].(string)
-				found = true
-				break
+	//apply the rules in order until a single result remains
+	var applied []string
+	for _, rule := range rules {
+
+		if len(matches) == 0 {
+			break
+		}
+		if len(matches) == 1 && len(applied) > 0 {
+			break
+		}
+
+		switch strings.TrimSpace(rule) {
+		case "controllerType":
+			var filtered []Insight
+			for _, insight := range matches {
+				if insight.ControllerType == objType {
+					filtered = append(filtered, insight)
+				}
 			}
+			matches = filtered
+		case "newest":
+			var filtered []Insight
+			for _, insight := range matches {
+				if len(filtered) == 0 || insight.RecommLastSeen > filtered[0].RecommLastSeen {
+					filtered = []Insight{insight}
+				} else if insight.RecommLastSeen == filtered[0].RecommLastSeen {
+					filtered = append(filtered, insight)
+				}
+			}
+			matches = filtered
+		case "max":
+			aggregate := aggregateMax(matches)
+			matches = []Insight{aggregate}
+			if len(aggregate.combined) > 1 {
+				var entityIDs []string
+				for _, insight := range aggregate.combined {
+					entityIDs = append(entityIDs, insight.EntityID)
+				}
+				applied = append(applied, "max of ["+strings.Join(entityIDs, ",")+"]")
+				continue
+			}
+		default:
+			continue
 		}
+		applied = append(applied, strings.TrimSpace(rule))
+
+	}
+
+	if len(matches) != 1 {
+		return Insight{}, "", errors.New("unable to locate insight")
+	}
+
+	return matches[0], strings.Join(applied, ","), nil
+
+}
+
+//aggregateMax combines the results into the max of their specs.  The combined results are kept so approvals and deployments
+//apply to every entity rather than the one whose own recommendation differs from the aggregate.
+func aggregateMax(matches []Insight) Insight {
 
-		if !found {
-			return nil, errors.New("unable to load analysis")
+	if len(matches) == 1 {
+		return matches[0]
+	}
+
+	//the newest result is kept for its audit info
+	aggregate := matches[0]
+	for _, insight := range matches[1:] {
+		if insight.RecommLastSeen > aggregate.RecommLastSeen {
+			newest := insight
+			newest.RecommendedCPULimit, newest.RecommendedCPURequest = aggregate.RecommendedCPULimit, aggregate.RecommendedCPURequest
+			newest.RecommendedMemLimit, newest.RecommendedMemRequest = aggregate.RecommendedMemLimit, aggregate.RecommendedMemRequest
+			newest.CurrentCPULimit, newest.CurrentCPURequest = aggregate.CurrentCPULimit, aggregate.CurrentCPURequest
+			newest.CurrentMemLimit, newest.CurrentMemRequest = aggregate.CurrentMemLimit, aggregate.CurrentMemRequest
+			aggregate = newest
 		}
+		aggregate.RecommendedCPULimit = math.Max(aggregate.RecommendedCPULimit, insight.RecommendedCPULimit)
+		aggregate.RecommendedCPURequest = math.Max(aggregate.RecommendedCPURequest, insight.RecommendedCPURequest)
+		aggregate.RecommendedMemLimit = math.Max(aggregate.RecommendedMemLimit, insight.RecommendedMemLimit)
+		aggregate.RecommendedMemRequest = math.Max(aggregate.RecommendedMemRequest, insight.RecommendedMemRequest)
+		aggregate.CurrentCPULimit = math.Max(aggregate.CurrentCPULimit, insight.CurrentCPULimit)
+		aggregate.CurrentCPURequest = math.Max(aggregate.CurrentCPURequest, insight.CurrentCPURequest)
+		aggregate.CurrentMemLimit = math.Max(aggregate.CurrentMemLimit, insight.CurrentMemLimit)
+		aggregate.CurrentMemRequest = math.Max(aggregate.CurrentMemRequest, insight.CurrentMemRequest)
+	}
+
+	for _, insight := range matches {
+		aggregate.combined = append(aggregate.combined, entities(insight)...)
+	}
+
+	return aggregate
+
+}
+
+func resolveAnalysis(cluster string, namespace string) (string, error) {
+
+	//namespace mappings take precedence over the default analysis, which defaults to the remote cluster name
+	selector := cluster
+	if val, ok := nsAnalyses[namespace]; ok {
+		selector = val
+	} else if analysis != "" {
+		selector = analysis
+	}
 
+	if analysisId, ok := analysisIds[selector]; ok {
+		return analysisId, nil
 	}
 
-	resp, err := support.HTTPRequest("GET", densifyURL+analysisEP+"/"+analysisId+"/results?cluster="+cluster+"&namespace="+namespace+"&container="+containerName+"&podService="+objName+"&controllerType="+objType, densifyUser+":"+densifyPass, nil)
+	if err := loadAnalyses(); err != nil {
+		return "", err
+	}
+
+	for _, val := range analyses {
+		if val["analysisId"] == selector || val["analysisName"] == selector {
+			analysisIds[selector] = fmt.Sprint(val["analysisId"])
+			return analysisIds[selector], nil
+		}
+	}
+
+	return "", errors.New("unable to load analysis [" + selector + "]")
+
+}
+
+func loadAnalyses() error {
+
+	if analyses != nil {
+		return nil
+	}
+
+	resp, err := request("GET", analysisEP, nil)
 	if err != nil {
-		return nil, err
+		return errors.New("unable to load analysis")
+	}
+
+	if err := json.Unmarshal([]byte(resp), &analyses); err != nil {
+		return errors.New("unable to load analysis")
 	}
 
-	var insights []map[string]interface{}
-	json.Unmarshal([]byte(resp), &insights)
+	return nil
+
+}
 
-	if len(insights) != 1 {
-		return nil, errors.New("unable to locate insight")
+func selectAnalysis(prompt string) string {
+
+	for {
+		var selectedValue string
+		fmt.Print(prompt)
+		fmt.Scanln(&selectedValue)
+		if selectedValue == "" || selectedValue == "0" {
+			return ""
+		}
+		if selection, err := strconv.Atoi(selectedValue); err == nil && selection >= 1 && selection <= len(analyses) {
+			return fmt.Sprint(analyses[selection-1]["analysisId"])
+		}
+		fmt.Println("Incorrect analysis selection.  Try again.")
 	}
 
-	return insights[0], nil
+}
+
+func parseNamespaceAnalyses(mappings string) map[string]string {
+
+	nsAnalyses := make(map[string]string)
+	for _, mapping := range strings.Split(mappings, ",") {
+		if pair := strings.SplitN(mapping, "=", 2); len(pair) == 2 && pair[0] != "" {
+			nsAnalyses[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+	}
+
+	return nsAnalyses
+
+}
+
+//entities returns the results an insight was aggregated from, or the insight itself
+func entities(insight Insight) []Insight {
+
+	if len(insight.combined) > 0 {
+		return insight.combined
+	}
+
+	return []Insight{insight}
+
+}
+
+//effectiveApprovalSetting returns the approval setting in effect along with the reason it differs from the one set in densify (if any).
+//An aggregated result is only approved when every combined entity is, and a specific change approval wins over any change.
+func effectiveApprovalSetting(insight Insight) (string, string) {
+
+	if len(insight.combined) > 0 {
+		approvalSetting := "Approve Any Change"
+		for _, entity := range insight.combined {
+			setting, reason := effectiveApprovalSetting(entity)
+			if setting == "Not Approved" {
+				if reason == "" {
+					reason = "not approved"
+				}
+				return setting, "entity " + entity.EntityID + " " + reason
+			}
+			if setting == "Approve Specific Change" {
+				approvalSetting = setting
+			}
+		}
+		return approvalSetting, ""
+	}
+
+	approvalSetting, err := getAttribute(insight.EntityID, "attr_ApprovalSetting")
+	if err != nil || approvalSetting == "" {
+		return "Not Approved", ""
+	}
+
+	if approvalSetting == "Not Approved" {
+		return approvalSetting, ""
+	}
+
+	//scheduled approvals are not honoured before their effective date
+	if val, err := getAttribute(insight.EntityID, "attr_ApprovalEffectiveDate"); err == nil && val != "" {
+		if effective, err := time.ParseInLocation("2006-01-02", val, time.Local); err == nil && time.Now().Before(effective) {
+			return "Not Approved", approvalSetting + " scheduled for " + val
+		}
+	}
+
+	//a specific change approval expires when the recommendation changes
+	if approvalSetting == "Approve Specific Change" {
+		if val, err := getAttribute(insight.EntityID, "attr_ApprovedRecommendation"); err == nil && val != "" && val != fingerprint(insight) {
+			return "Not Approved", "approval expired - recommendation changed"
+		}
+	}
+
+	return approvalSetting, ""
+
+}
+
+//approvalAttributes returns the attributes to update for an approval.  The approved recommendation and effective date
+//are only sent when set, or when a previous value has to be cleared, so densify instances without them still work.
+func approvalAttributes(entity Insight, approvalSetting string, effective time.Time) []map[string]string {
+
+	//a specific change approval is tied to the recommendation it was given for
+	approvedRecommendation, effectiveDate := "", ""
+	if approvalSetting == "Approve Specific Change" {
+		approvedRecommendation = fingerprint(entity)
+	}
+	if approvalSetting != "Not Approved" && !effective.IsZero() {
+		effectiveDate = effective.Format("2006-01-02")
+	}
+
+	attributes := []map[string]string{{"name": "Approval Setting", "value": approvalSetting}}
+	if previous, _ := getAttribute(entity.EntityID, "attr_ApprovedRecommendation"); approvedRecommendation != "" || previous != "" {
+		attributes = append(attributes, map[string]string{"name": "Approved Recommendation", "value": approvedRecommendation})
+	}
+	if previous, _ := getAttribute(entity.EntityID, "attr_ApprovalEffectiveDate"); effectiveDate != "" || previous != "" {
+		attributes = append(attributes, map[string]string{"name": "Approval Effective Date", "value": effectiveDate})
+	}
+
+	return attributes
 
 }
 
+//quantities converts a spec in millicores and Mi into k8s quantities, nil if incomplete
+func quantities(cpuLimit float64, memLimit float64, cpuRequest float64, memRequest float64) map[string]map[string]string {
+
+	if cpuLimit <= 0 || memLimit <= 0 || cpuRequest <= 0 || memRequest <= 0 {
+		return nil
+	}
+
+	return map[string]map[string]string{
+		"limits": {
+			"cpu":    strconv.FormatFloat(cpuLimit, 'f', -1, 64) + "m",
+			"memory": strconv.FormatFloat(memLimit, 'f', -1, 64) + "Mi",
+		},
+		"requests": {
+			"cpu":    strconv.FormatFloat(cpuRequest, 'f', -1, 64) + "m",
+			"memory": strconv.FormatFloat(memRequest, 'f', -1, 64) + "Mi",
+		},
+	}
+
+}
+
+func fingerprint(insight Insight) string {
+	return "cpuRequest=" + strconv.FormatFloat(insight.RecommendedCPURequest, 'f', -1, 64) +
+		",cpuLimit=" + strconv.FormatFloat(insight.RecommendedCPULimit, 'f', -1, 64) +
+		",memRequest=" + strconv.FormatFloat(insight.RecommendedMemRequest, 'f', -1, 64) +
+		",memLimit=" + strconv.FormatFloat(insight.RecommendedMemLimit, 'f', -1, 64)
+}
+
 func getAttribute(entityID string, attrID string) (string, error) {
 
-	resp, err := support.HTTPRequest("GET", densifyURL+systemsEP+"/"+entityID, densifyUser+":"+densifyPass, nil)
+	//fetch all attributes of the entity once
+	if _, ok := attributeCache[entityID]; !ok {
+		attributes, err := fetchAttributes(entityID)
+		if err != nil {
+			return "", errors.New("error locating attribute[" + attrID + "]")
+		}
+		attributeCache[entityID] = attributes
+	}
+
+	if val, ok := attributeCache[entityID][attrID]; ok {
+		return val, nil
+	}
+
+	return "", errors.New("error locating attribute[" + attrID + "]")
+
+}
+
+//fetchAttributes fetches all attributes of an entity, it's safe to call concurrently
+func fetchAttributes(entityID string) (map[string]string, error) {
+
+	resp, err := request("GET", systemsEP+"/"+entityID, nil)
 	if err != nil {
-		return "", errors.New("error locating attribute[" + attrID + "]")
+		return nil, err
 	}
 
 	var respMap map[string]interface{}
 	json.Unmarshal([]byte(resp), &respMap)
 
-	for _, val := range respMap["attributes"].([]interface{}) {
-		if val.(map[string]interface{})["id"] == attrID {
-			return val.(map[string]interface{})["value"].(string), nil
+	attributes := make(map[string]string)
+	if attributeList, ok := respMap["attributes"].([]interface{}); ok {
+		for _, val := range attributeList {
+			if attribute, ok := val.(map[string]interface{}); ok {
+				id, _ := attribute["id"].(string)
+				value, _ := attribute["value"].(string)
+				attributes[id] = value
+			}
 		}
 	}
 
-	return "", errors.New("error locating attribute[" + attrID + "]")
+	return attributes, nil
+
+}
+
+//loadSecrets loads the stored densify secrets and validates them
+func loadSecrets(storedSecrets map[string]string) error {
+
+	if _, ok := storedSecrets["densifyURL"]; !ok {
+		return errors.New("densify is not configured - select the Densify adapter with helm optimize -c --adapter")
+	}
+
+	densifyURL = storedSecrets["densifyURL"]
+	densifyUser = storedSecrets["densifyUser"]
+	densifyPass = storedSecrets["densifyPass"]
+	densifyAPIKey = storedSecrets["densifyAPIKey"]
+	densifyToken = storedSecrets["densifyToken"]
+	analysis = storedSecrets["densifyAnalysis"]
+	nsAnalyses = parseNamespaceAnalyses(storedSecrets["densifyNamespaceAnalyses"])
+	if val, ok := storedSecrets["densifyDeployAttribute"]; ok && val != "" {
+		deployAttr = val
+	}
+	if val, ok := storedSecrets["densifyDisambiguation"]; ok && val != "" {
+		rules = strings.Split(val, ",")
+	}
+	if expiry, err := strconv.ParseInt(storedSecrets["densifyTokenExpiry"], 10, 64); err == nil {
+		tokenExpiry = time.Unix(0, expiry*int64(time.Millisecond))
+	}
+
+	//credentials from a credential source are resolved on every run and never stored
+	if credentialSource = storedSecrets["densifyCredentialSource"]; credentialSource != "" {
+		if err := resolveCredential(); err != nil {
+			return err
+		}
+	}
+
+	if err := validateSecrets(); err != nil {
+		return err
+	}
+
+	//replace a stored password with the token (storing also selects densify as the adapter, so only when it is already selected)
+	if _, ok := storedSecrets["densifyPass"]; (ok || (credentialSource == "" && densifyToken != storedSecrets["densifyToken"])) && storedSecrets["adapter"] == "Densify" {
+		storeSecrets()
+	}
+
+	return nil
+
+}
+
+//resolveCredential resolves the credentials from the credential source.  With a username the secret is a password, otherwise an api key.
+func resolveCredential() error {
+
+	credential, err := support.ResolveCredential(credentialSource, densifyURL)
+	if err != nil {
+		return err
+	}
+
+	densifyPass, densifyAPIKey, densifyToken, tokenExpiry = "", "", "", time.Time{}
+	if credential.Username != "" {
+		densifyUser = credential.Username
+	}
+	if densifyUser != "" {
+		densifyPass = credential.Secret
+	} else {
+		densifyAPIKey = credential.Secret
+	}
+
+	return nil
 
 }
 
 func validateSecrets() error {
 
+	//api keys are validated by listing the analyses
+	if densifyAPIKey != "" {
+		_, _, err := support.HTTPRequestWithAuth("GET", densifyURL+analysisEP, "Bearer "+densifyAPIKey, nil)
+		return err
+	}
+
+	//reuse the token until it expires
+	if densifyToken != "" && time.Now().Add(time.Minute).Before(tokenExpiry) {
+		return nil
+	}
+
+	if densifyPass == "" {
+		return errors.New("densify session has expired - please re-enter your password")
+	}
+
+	return authorize()
+
+}
+
+func authorize() error {
+
 	jsonReq, err := json.Marshal(map[string]string{
 		"userName": densifyUser,
 		"pwd":      densifyPass,
@@ -264,22 +1066,89 @@ func validateSecrets() error {
 		return err
 	}
 
-	_, err = support.HTTPRequest("POST", densifyURL+authorizeEP, densifyUser+":"+densifyPass, jsonReq)
+	resp, err := support.HTTPRequest("POST", densifyURL+authorizeEP, densifyUser+":"+densifyPass, jsonReq)
 	if err != nil {
 		return err
 	}
 
+	var respMap map[string]interface{}
+	json.Unmarshal([]byte(resp), &respMap)
+
+	token, ok := respMap["apiToken"].(string)
+	if !ok || token == "" {
+		return errors.New("unable to obtain densify api token")
+	}
+	densifyToken = token
+
+	//expires is reported in epoch milliseconds, default to 5 minutes if not reported
+	if expires, ok := respMap["expires"].(float64); ok {
+		tokenExpiry = time.Unix(0, int64(expires)*int64(time.Millisecond))
+	} else {
+		tokenExpiry = time.Now().Add(5 * time.Minute)
+	}
+
 	return nil
 
 }
 
+func request(method string, endpoint string, body []byte) (string, error) {
+
+	if densifyAPIKey != "" {
+		resp, _, err := support.HTTPRequestWithAuth(method, densifyURL+endpoint, "Bearer "+densifyAPIKey, body)
+		return resp, err
+	}
+
+	tokenLock.Lock()
+	err := validateSecrets()
+	token := densifyToken
+	tokenLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	resp, status, err := support.HTTPRequestWithAuth(method, densifyURL+endpoint, "Bearer "+token, body)
+
+	//refresh the token once if it was rejected, unless a concurrent request already refreshed it
+	if status == 401 && densifyPass != "" {
+		tokenLock.Lock()
+		var authErr error
+		if densifyToken == token {
+			authErr = authorize()
+		}
+		token = densifyToken
+		tokenLock.Unlock()
+		if authErr != nil {
+			return "", authErr
+		}
+		resp, _, err = support.HTTPRequestWithAuth(method, densifyURL+endpoint, "Bearer "+token, body)
+	}
+
+	return resp, err
+
+}
+
 func storeSecrets() {
 
 	storeSecrets := make(map[string]string)
 	storeSecrets["adapter"] = "Densify"
 	storeSecrets["densifyURL"] = densifyURL
 	storeSecrets["densifyUser"] = densifyUser
-	storeSecrets["densifyPass"] = densifyPass
-	support.StoreSecrets("helm-optimize-plugin", storeSecrets)
+	if credentialSource != "" {
+		storeSecrets["densifyCredentialSource"] = credentialSource
+	} else if densifyAPIKey != "" {
+		storeSecrets["densifyAPIKey"] = densifyAPIKey
+	} else {
+		storeSecrets["densifyToken"] = densifyToken
+		storeSecrets["densifyTokenExpiry"] = strconv.FormatInt(tokenExpiry.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	//the password is never stored once a token or api key is available, and nothing is stored when a credential source is used
+	staleKeys := []string{"densifyPass", "densifyAPIKey", "densifyCredentialSource"}
+	if credentialSource != "" {
+		staleKeys = []string{"densifyPass", "densifyAPIKey", "densifyToken", "densifyTokenExpiry"}
+	} else if densifyAPIKey != "" {
+		staleKeys = []string{"densifyPass", "densifyToken", "densifyTokenExpiry", "densifyCredentialSource"}
+	}
+	support.UpdateSecrets("helm-optimize-plugin", storeSecrets, staleKeys)
 
 }
@@ -0,0 +1,287 @@
+package densify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAggregateMax(t *testing.T) {
+
+	matches := []Insight{
+		{EntityID: "a", RecommLastSeen: 100, RecommendedCPURequest: 200, RecommendedMemLimit: 512, CurrentCPURequest: 100},
+		{EntityID: "b", RecommLastSeen: 300, RecommendedCPURequest: 100, RecommendedMemLimit: 1024, CurrentCPURequest: 50},
+		{EntityID: "c", RecommLastSeen: 200, RecommendedCPURequest: 150, RecommendedMemLimit: 256, CurrentCPURequest: 300},
+	}
+
+	aggregate := aggregateMax(matches)
+	if aggregate.RecommendedCPURequest != 200 || aggregate.RecommendedMemLimit != 1024 || aggregate.CurrentCPURequest != 300 {
+		t.Errorf("aggregateMax specs = %v/%v/%v, want 200/1024/300", aggregate.RecommendedCPURequest, aggregate.RecommendedMemLimit, aggregate.CurrentCPURequest)
+	}
+	if aggregate.RecommLastSeen != 300 {
+		t.Errorf("aggregateMax RecommLastSeen = %v, want the newest (300)", aggregate.RecommLastSeen)
+	}
+
+	var combined []string
+	for _, entity := range entities(aggregate) {
+		combined = append(combined, entity.EntityID)
+	}
+	if !reflect.DeepEqual(combined, []string{"a", "b", "c"}) {
+		t.Errorf("aggregateMax combined = %v, want [a b c]", combined)
+	}
+
+	if single := aggregateMax(matches[:1]); len(single.combined) != 0 {
+		t.Errorf("aggregateMax of a single result should not combine, got %v", single.combined)
+	}
+
+}
+
+func TestDisambiguate(t *testing.T) {
+
+	matches := []Insight{
+		{EntityID: "a", ControllerType: "Deployment", RecommLastSeen: 100},
+		{EntityID: "b", ControllerType: "Deployment", RecommLastSeen: 200},
+		{EntityID: "c", ControllerType: "ReplicaSet", RecommLastSeen: 300},
+	}
+
+	tests := []struct {
+		rules      []string
+		entityID   string
+		resolution string
+		err        bool
+	}{
+		{[]string{"controllerType", "newest", "max"}, "b", "controllerType,newest", false},
+		{[]string{"newest"}, "c", "newest", false},
+		{[]string{"controllerType", "max"}, "b", "controllerType,max of [a,b]", false},
+		{[]string{"controllerType"}, "", "", true},
+	}
+
+	defer func(original []string) { rules = original }(rules)
+	for _, test := range tests {
+		rules = test.rules
+		insight, resolution, err := disambiguate(matches, "Deployment")
+		if (err != nil) != test.err {
+			t.Errorf("%v: disambiguate error = %v, want error %v", test.rules, err, test.err)
+			continue
+		}
+		if err == nil && (insight.EntityID != test.entityID || resolution != test.resolution) {
+			t.Errorf("%v: disambiguate = %s [%s], want %s [%s]", test.rules, insight.EntityID, resolution, test.entityID, test.resolution)
+		}
+	}
+
+}
+
+func TestEffectiveApprovalSettingAggregated(t *testing.T) {
+
+	defer func() { attributeCache = make(map[string]map[string]string) }()
+
+	a := Insight{EntityID: "a", RecommendedCPURequest: 100}
+	b := Insight{EntityID: "b", RecommendedCPURequest: 200}
+	aggregate := aggregateMax([]Insight{a, b})
+
+	tests := []struct {
+		name     string
+		a        map[string]string
+		b        map[string]string
+		approval string
+	}{
+		{"every entity approved", map[string]string{"attr_ApprovalSetting": "Approve Any Change"}, map[string]string{"attr_ApprovalSetting": "Approve Any Change"}, "Approve Any Change"},
+		{"specific change wins", map[string]string{"attr_ApprovalSetting": "Approve Any Change"}, map[string]string{"attr_ApprovalSetting": "Approve Specific Change", "attr_ApprovedRecommendation": fingerprint(b)}, "Approve Specific Change"},
+		{"one entity not approved", map[string]string{"attr_ApprovalSetting": "Approve Any Change"}, map[string]string{"attr_ApprovalSetting": "Not Approved"}, "Not Approved"},
+		{"one approval expired", map[string]string{"attr_ApprovalSetting": "Approve Specific Change", "attr_ApprovedRecommendation": fingerprint(b)}, map[string]string{"attr_ApprovalSetting": "Approve Any Change"}, "Not Approved"},
+	}
+
+	for _, test := range tests {
+		attributeCache = map[string]map[string]string{"a": test.a, "b": test.b}
+		if approval, reason := effectiveApprovalSetting(aggregate); approval != test.approval {
+			t.Errorf("%s: effectiveApprovalSetting = %s (%s), want %s", test.name, approval, reason, test.approval)
+		}
+	}
+
+}
+
+func TestApprovalAttributes(t *testing.T) {
+
+	defer func() { attributeCache = make(map[string]map[string]string) }()
+
+	entity := Insight{EntityID: "a", RecommendedCPURequest: 100}
+	effective := time.Date(2030, 1, 2, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name       string
+		stored     map[string]string
+		setting    string
+		effective  time.Time
+		attributes []string
+	}{
+		{"approval setting only", map[string]string{}, "Approve Any Change", time.Time{}, []string{"Approval Setting=Approve Any Change"}},
+		{"specific change", map[string]string{}, "Approve Specific Change", time.Time{}, []string{"Approval Setting=Approve Specific Change", "Approved Recommendation=" + fingerprint(entity)}},
+		{"scheduled", map[string]string{}, "Approve Any Change", effective, []string{"Approval Setting=Approve Any Change", "Approval Effective Date=2030-01-02"}},
+		{"not approved ignores the date", map[string]string{}, "Not Approved", effective, []string{"Approval Setting=Not Approved"}},
+		{"previous values cleared", map[string]string{"attr_ApprovedRecommendation": "x", "attr_ApprovalEffectiveDate": "2020-01-01"}, "Approve Any Change", time.Time{}, []string{"Approval Setting=Approve Any Change", "Approved Recommendation=", "Approval Effective Date="}},
+	}
+
+	for _, test := range tests {
+		attributeCache = map[string]map[string]string{"a": test.stored}
+		var attributes []string
+		for _, attribute := range approvalAttributes(entity, test.setting, test.effective) {
+			attributes = append(attributes, attribute["name"]+"="+attribute["value"])
+		}
+		if !reflect.DeepEqual(attributes, test.attributes) {
+			t.Errorf("%s: approvalAttributes = %q, want %q", test.name, attributes, test.attributes)
+		}
+	}
+
+}
+
+func TestQuantities(t *testing.T) {
+
+	//densify reports millicores and Mi
+	if spec := quantities(1000, 512, 500, 256); !reflect.DeepEqual(spec, map[string]map[string]string{
+		"limits":   {"cpu": "1000m", "memory": "512Mi"},
+		"requests": {"cpu": "500m", "memory": "256Mi"},
+	}) {
+		t.Errorf("quantities = %v", spec)
+	}
+
+	if spec := quantities(1000, 0, 500, 256); spec != nil {
+		t.Errorf("quantities with a missing value = %v, want nil", spec)
+	}
+
+}
+
+//TestPrefetchAttributes fetches the results of a namespace against a fake densify, and checks the attributes of every entity are fetched once (with a single token refresh) and served from memory
+func TestPrefetchAttributes(t *testing.T) {
+
+	var insights []Insight
+	for i := 0; i < 20; i++ {
+		insights = append(insights, Insight{EntityID: "e" + strconv.Itoa(i), Namespace: "ns", PodService: "web" + strconv.Itoa(i), Container: "app"})
+	}
+
+	var lock sync.Mutex
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.URL.Path == authorizeEP:
+			calls["authorize"]++
+			json.NewEncoder(w).Encode(map[string]string{"apiToken": "fresh"})
+		case r.Header.Get("Authorization") != "Bearer fresh":
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.HasPrefix(r.URL.Path, analysisEP):
+			calls["results"]++
+			json.NewEncoder(w).Encode(insights)
+		case r.URL.Path == systemsEP+"/e3":
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.HasPrefix(r.URL.Path, systemsEP+"/"):
+			calls["systems"]++
+			entityID := strings.TrimPrefix(r.URL.Path, systemsEP+"/")
+			json.NewEncoder(w).Encode(map[string]interface{}{"attributes": []map[string]string{{"id": "attr_ApprovalSetting", "value": "Approved " + entityID}}})
+		}
+	}))
+	defer server.Close()
+
+	defer func(originalURL string, originalPass string, originalToken string, originalExpiry time.Time) {
+		densifyURL, densifyPass, densifyToken, tokenExpiry = originalURL, originalPass, originalToken, originalExpiry
+		insightCache, attributeCache = make(map[string][]Insight), make(map[string]map[string]string)
+	}(densifyURL, densifyPass, densifyToken, tokenExpiry)
+	densifyURL, densifyPass, densifyToken, tokenExpiry = server.URL, "pass", "stale", time.Now().Add(time.Hour)
+
+	if _, err := fetchInsights("a1", "c1", "ns"); err != nil {
+		t.Fatal(err)
+	}
+	for _, insight := range insights {
+		if insight.EntityID == "e3" {
+			continue
+		}
+		if val, err := getAttribute(insight.EntityID, "attr_ApprovalSetting"); err != nil || val != "Approved "+insight.EntityID {
+			t.Errorf("getAttribute(%s) = %s (%v), want Approved %s", insight.EntityID, val, err, insight.EntityID)
+		}
+	}
+	if _, err := getAttribute("e3", "attr_ApprovalSetting"); err == nil {
+		t.Errorf("getAttribute(e3) succeeded, want the failed entity to be retried and reported")
+	}
+
+	if calls["authorize"] != 1 || calls["results"] != 1 || calls["systems"] != 19 {
+		t.Errorf("calls = %v, want 1 authorize, 1 results and 19 systems", calls)
+	}
+
+}
+
+//TestRecommendations resolves the recommendations of a cluster against a fake densify, with a namespace mapped to its own analysis
+func TestRecommendations(t *testing.T) {
+
+	spec := func(insight Insight, current bool) Insight {
+		insight.ControllerType, insight.Container, insight.RecommLastSeen = "Deployment", "app", 1000
+		insight.RecommendedCPULimit, insight.RecommendedMemLimit, insight.RecommendedCPURequest, insight.RecommendedMemRequest = 500, 512, 250, 256
+		if current {
+			insight.CurrentCPULimit, insight.CurrentMemLimit, insight.CurrentCPURequest, insight.CurrentMemRequest = 1000, 1024, 500, 512
+		}
+		return insight
+	}
+	clusterResults := []Insight{
+		spec(Insight{EntityID: "e1", Namespace: "ns", PodService: "web"}, true),
+		spec(Insight{EntityID: "e2", Namespace: "ns", PodService: "worker"}, false),
+		spec(Insight{EntityID: "e3", Namespace: "ns", PodService: "dup"}, true),
+		spec(Insight{EntityID: "e4", Namespace: "ns", PodService: "dup"}, true),
+		{EntityID: "e5", Namespace: "ns", PodService: "norec", ControllerType: "Deployment", Container: "app"},
+		spec(Insight{EntityID: "e6", Namespace: "tenant", PodService: "stale"}, true),
+	}
+	tenantResults := []Insight{spec(Insight{EntityID: "e7", Namespace: "tenant", PodService: "api"}, true)}
+	approvals := map[string]string{"e1": "Approve Any Change", "e7": "Approve Any Change"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case analysisEP:
+			json.NewEncoder(w).Encode([]map[string]string{{"analysisId": "a1", "analysisName": "c1"}, {"analysisId": "a2", "analysisName": "tenant-analysis"}})
+		case analysisEP + "/a1/results":
+			json.NewEncoder(w).Encode(clusterResults)
+		case analysisEP + "/a2/results":
+			json.NewEncoder(w).Encode(tenantResults)
+		default:
+			entityID := strings.TrimPrefix(r.URL.Path, systemsEP+"/")
+			json.NewEncoder(w).Encode(map[string]interface{}{"attributes": []map[string]string{{"id": "attr_ApprovalSetting", "value": approvals[entityID]}}})
+		}
+	}))
+	defer server.Close()
+
+	defer func(originalURL string, originalKey string, originalAnalysis string, originalNsAnalyses map[string]string, originalRules []string) {
+		densifyURL, densifyAPIKey, analysis, nsAnalyses, rules = originalURL, originalKey, originalAnalysis, originalNsAnalyses, originalRules
+		analyses, analysisIds = nil, make(map[string]string)
+		insightCache, attributeCache = make(map[string][]Insight), make(map[string]map[string]string)
+	}(densifyURL, densifyAPIKey, analysis, nsAnalyses, rules)
+	densifyURL, densifyAPIKey, analysis, nsAnalyses = server.URL, "key", "", map[string]string{"tenant": "tenant-analysis"}
+	rules = []string{"controllerType", "newest"}
+
+	recommendations, unresolved, err := Recommendations("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recommended := map[string]map[string]string{"limits": {"cpu": "500m", "memory": "512Mi"}, "requests": {"cpu": "250m", "memory": "256Mi"}}
+	current := map[string]map[string]string{"limits": {"cpu": "1000m", "memory": "1024Mi"}, "requests": {"cpu": "500m", "memory": "512Mi"}}
+	tests := []Recommendation{
+		{Namespace: "ns", ObjType: "Deployment", ObjName: "web", Container: "app", Current: current, Recommended: recommended, ApprovalSetting: "Approve Any Change"},
+		{Namespace: "ns", ObjType: "Deployment", ObjName: "worker", Container: "app", Current: nil, Recommended: recommended, ApprovalSetting: "Not Approved"},
+		{Namespace: "tenant", ObjType: "Deployment", ObjName: "api", Container: "app", Current: current, Recommended: recommended, ApprovalSetting: "Approve Any Change"},
+	}
+	if !reflect.DeepEqual(recommendations, tests) {
+		t.Errorf("Recommendations = %+v, want %+v", recommendations, tests)
+	}
+
+	wantUnresolved := []string{
+		"ns/Deployment/dup/app: 2 results not resolved by the disambiguation rules",
+		"ns/Deployment/norec/app: invalid recommended spec",
+	}
+	if !reflect.DeepEqual(unresolved, wantUnresolved) {
+		t.Errorf("unresolved = %v, want %v", unresolved, wantUnresolved)
+	}
+
+}
@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/densify-quick-start/helm-optimize-resources/densify"
+	"github.com/densify-quick-start/helm-optimize-resources/policy"
 	"github.com/densify-quick-start/helm-optimize-resources/ssm"
 	"github.com/densify-quick-start/helm-optimize-resources/support"
 	"github.com/ghodss/yaml"
@@ -24,8 +27,13 @@ var availableAdapters = map[int]string{
 	2: "Parameter Store",
 }
 var adapter string
+var reconfigure bool
 var localCluster string
+var kubeContext string
 var remoteCluster string
+var lookupRules []support.LookupRule
+var aliasLabels bool
+var workloadAliases map[string]string
 var namespace string
 var objTypeContainerPath = map[string]string{
 	"Pod":                   "{.spec.containers}",
@@ -38,6 +46,49 @@ var objTypeContainerPath = map[string]string{
 	"Deployment":            "{.spec.template.spec.containers}",
 }
 
+var resizePolicyMode string
+var resizeReport []string
+var userPolicyPath string
+var userPolicy *policy.Policy
+var valuesOverrides map[string]interface{}
+var appliedInsights []map[string]string
+var onlyNamespaces string
+var excludeKinds string
+var labelSelector string
+var parsedSelector support.Selector
+var releaseName string
+var configPath string
+var configStore string
+var adapterOverride string
+var remoteClusterOverride string
+var profileName string
+var aliasFilePath string
+
+//pluginFlags are consumed by the plugin and are not passed along to helm
+var pluginFlags = map[string]*string{
+	"--config":         &configPath,
+	"--config-store":   &configStore,
+	"--use-adapter":    &adapterOverride,
+	"--remote-cluster": &remoteClusterOverride,
+	"--profile":        &profileName,
+	"--aliases":        &aliasFilePath,
+}
+
+//chartFlags are only consumed by the plugin for the commands it optimizes, every other command passes them along to helm (eg. helm optimize list --selector)
+var chartFlags = map[string]*string{
+	"--resize-policy":   &resizePolicyMode,
+	"--policy":          &userPolicyPath,
+	"--only-namespaces": &onlyNamespaces,
+	"--exclude-kinds":   &excludeKinds,
+	"--selector":        &labelSelector,
+}
+
+//optimizedCommands are the helm commands the plugin optimizes the chart of
+var optimizedCommands = []string{"install", "upgrade", "template"}
+
+//secretConfigKeys are masked when showing the configuration
+var secretConfigKeys = []string{"densifyPass", "densifyAPIKey", "densifyToken", "externalId"}
+
 //HelmBin location of helm installation
 var HelmBin string = os.Getenv("HELM_BIN")
 
@@ -61,9 +112,9 @@ func initializeAdapter() error {
 	var err error
 	switch adapter {
 	case "Densify":
-		err = densify.Initialize()
+		err = densify.Initialize(reconfigure)
 	case "Parameter Store":
-		err = ssm.Initialize()
+		err = ssm.Initialize(reconfigure)
 	}
 
 	if err != nil {
@@ -101,15 +152,76 @@ func getInsight(cluster string, namespace string, objType string, objName string
 
 }
 
-func updateApprovalSetting(approved bool, cluster string, namespace string, objType string, objName string, containerName string) error {
+func getInsightMeta(cluster string, namespace string, objType string, objName string, containerName string) (support.InsightMeta, error) {
+
+	var meta support.InsightMeta
+	var err error
+
+	switch adapter {
+	case "Densify":
+		meta, err = densify.GetInsightMeta(cluster, namespace, objType, objName, containerName)
+	case "Parameter Store":
+		meta, err = ssm.GetInsightMeta(cluster, namespace, objType, objName, containerName)
+	}
+
+	return meta, err
+
+}
+
+func getPodInsight(cluster string, namespace string, objType string, objName string) (map[string]map[string]string, string, error) {
+
+	var insight map[string]map[string]string
+	var approvalSetting string
+	var err error
+
+	switch adapter {
+	case "Densify":
+		insight, approvalSetting, err = densify.GetPodInsight(cluster, namespace, objType, objName)
+	case "Parameter Store":
+		insight, approvalSetting, err = ssm.GetPodInsight(cluster, namespace, objType, objName)
+	}
+
+	if err != nil {
+		return nil, "Not Approved", err
+	}
+
+	return insight, approvalSetting, nil
+
+}
+
+func updateApprovalSetting(approvalSetting string, effective time.Time, cluster string, namespace string, objType string, objName string, containerName string) error {
 
 	var err error
 
 	switch adapter {
 	case "Densify":
-		err = densify.UpdateApprovalSetting(approved, cluster, namespace, objType, objName, containerName)
+		err = densify.UpdateApprovalSetting(approvalSetting, effective, cluster, namespace, objType, objName, containerName)
 	case "Parameter Store":
-		err = ssm.UpdateApprovalSetting(approved, cluster, namespace, objType, objName, containerName)
+		err = ssm.UpdateApprovalSetting(approvalSetting != "Not Approved", cluster, namespace, objType, objName, containerName)
+	}
+
+	return err
+
+}
+
+func approvalSettings() ([]string, bool) {
+
+	switch adapter {
+	case "Densify":
+		return densify.ApprovalSettings, true
+	}
+
+	return []string{"Not Approved", "Approved"}, false
+
+}
+
+func recordDeployment(cluster string, namespace string, objType string, objName string, containerName string, release string, revision string, deployedAt time.Time, deviations string) error {
+
+	var err error
+
+	switch adapter {
+	case "Densify":
+		err = densify.RecordDeployment(cluster, namespace, objType, objName, containerName, release, revision, deployedAt, deviations)
 	}
 
 	return err
@@ -132,6 +244,26 @@ func getApprovalSetting(cluster string, namespace string, objType string, objNam
 
 }
 
+func seedParameter(cluster string, namespace string, objType string, objName string, containerName string, resources map[string]map[string]string) (bool, error) {
+
+	switch adapter {
+	case "Parameter Store":
+		return ssm.SeedParameter(cluster, namespace, objType, objName, containerName, resources)
+	}
+
+	return false, errors.New("seeding is not supported by the " + adapter + " adapter")
+
+}
+
+func setReleaseContext(release string, chart string) {
+
+	switch adapter {
+	case "Parameter Store":
+		ssm.SetReleaseContext(release, chart)
+	}
+
+}
+
 ////////////////////////////////////////////////////////
 /////////////////SUPPORTING FUNCTIONS///////////////////
 ////////////////////////////////////////////////////////
@@ -163,6 +295,122 @@ func selectAdapter() {
 
 }
 
+func selectRemoteCluster() {
+
+	remoteCluster = ""
+	fmt.Print("Please specify remote cluster [" + localCluster + "]: ")
+	fmt.Scanln(&remoteCluster)
+	if remoteCluster == "" {
+		remoteCluster = localCluster
+	}
+	support.StoreSecrets("helm-optimize-plugin", map[string]string{"remoteCluster": remoteCluster})
+
+}
+
+func selectLookupMappings() {
+
+	fmt.Println("Mapping rules redirect the lookups of local workloads, eg. staging-cluster/staging/*=prod-cluster/prod/*")
+	fmt.Println("Local values are glob patterns, and a remote value of * keeps the local value (or the remote cluster).")
+	fmt.Println("A * within a remote value is replaced by the text matched by the * of the local value, eg. */staging-*/*=*/prod-*/*")
+	for _, rule := range lookupRules {
+		fmt.Println("  current: " + rule.String())
+	}
+
+	var rules []string
+	for {
+		var rule string
+		fmt.Print("Mapping rule <cluster>/<namespace>/<name>=<cluster>/<namespace>/<name> [done]: ")
+		fmt.Scanln(&rule)
+		if rule == "" {
+			break
+		}
+		if _, err := support.ParseLookupRules(rule); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	if len(rules) == 0 {
+		support.RemoveSecretData("helm-optimize-plugin", "lookupMappings")
+		return
+	}
+	support.StoreSecrets("helm-optimize-plugin", map[string]string{"lookupMappings": strings.Join(rules, ",")})
+
+}
+
+func selectWorkloadAlias() {
+
+	fmt.Println("Key repository lookups by")
+	fmt.Println("  1. workload name")
+	fmt.Println("  2. app.kubernetes.io/name and app.kubernetes.io/component labels (falls back to the workload name, Parameter Store only)")
+	fmt.Print("Selection: ")
+
+	var selectedValue string
+	fmt.Scanln(&selectedValue)
+	switch selectedValue {
+	case "1":
+		support.RemoveSecretData("helm-optimize-plugin", "workloadAlias")
+	case "2":
+		support.StoreSecrets("helm-optimize-plugin", map[string]string{"workloadAlias": "labels"})
+	default:
+		fmt.Println("Incorrect selection.")
+	}
+
+}
+
+func selectApprovalSetting(objNamespace string, objType string, objName string, containerName string) error {
+
+	settings, schedulable := approvalSettings()
+
+	fmt.Print("  0. Keep")
+	for i, setting := range settings {
+		fmt.Print("  " + strconv.Itoa(i+1) + ". " + setting)
+	}
+	fmt.Println("")
+
+	var selection int
+	for {
+		var selectedValue string
+		fmt.Print("  Selection [0]: ")
+		fmt.Scanln(&selectedValue)
+		if selectedValue == "" {
+			return nil
+		}
+		var err error
+		if selection, err = strconv.Atoi(selectedValue); err != nil || selection < 0 || selection > len(settings) {
+			fmt.Println("  Incorrect selection.  Try again.")
+			continue
+		}
+		break
+	}
+
+	if selection == 0 {
+		return nil
+	}
+	approvalSetting := settings[selection-1]
+
+	//approvals can be scheduled to take effect on a later date
+	var effective time.Time
+	for schedulable && approvalSetting != "Not Approved" {
+		var effectiveDate string
+		fmt.Print("  Effective date (YYYY-MM-DD) [now]: ")
+		fmt.Scanln(&effectiveDate)
+		if effectiveDate == "" {
+			break
+		}
+		var err error
+		if effective, err = time.ParseInLocation("2006-01-02", effectiveDate, time.Local); err != nil {
+			fmt.Println("  Incorrect date.  Try again.")
+			continue
+		}
+		break
+	}
+
+	return updateApprovalSetting(approvalSetting, effective, remoteCluster, objNamespace, objType, objName, containerName)
+
+}
+
 func processPluginSwitches(args []string) {
 
 	//Check if user requesting help
@@ -174,6 +422,8 @@ func processPluginSwitches(args []string) {
 	if args[0] == "-c" && len(args) == 2 {
 		//Check if user is configuring adapter
 		if args[1] == "--adapter" {
+			//the adapter is always prompted for, so a failing stored configuration (eg. a credential source) can be replaced
+			reconfigure = true
 			selectAdapter()
 			initializeAdapter()
 			os.Exit(0)
@@ -181,20 +431,44 @@ func processPluginSwitches(args []string) {
 
 		//Check if user is configuring adapter
 		if args[1] == "--cluster-mapping" {
-			remoteCluster = ""
-			fmt.Print("Please specify remote cluster [" + localCluster + "]: ")
-			fmt.Scanln(&remoteCluster)
-			if remoteCluster == "" {
-				remoteCluster = localCluster
+			selectRemoteCluster()
+			os.Exit(0)
+		}
+
+		//Check if user is configuring lookup mappings
+		if args[1] == "--lookup-mapping" {
+			selectLookupMappings()
+			os.Exit(0)
+		}
+
+		//Check if user is configuring workload aliases
+		if args[1] == "--workload-alias" {
+			selectWorkloadAlias()
+			os.Exit(0)
+		}
+
+		//Check if user is selecting densify analysis
+		if args[1] == "--analysis" {
+			if err := initializeAdapter(); err != nil {
+				os.Exit(0)
 			}
-			support.StoreSecrets("helm-optimize-plugin", map[string]string{"remoteCluster": remoteCluster})
+			if adapter != "Densify" {
+				fmt.Println("analysis selection is only available for the Densify adapter")
+				os.Exit(0)
+			}
+			support.CheckError("", densify.ConfigureAnalysis(), false)
 			os.Exit(0)
 		}
 
 		//check if user is clearing config
 		if args[1] == "--clear-config" {
-			support.LocateConfigNamespace("helm-optimize-plugin")
-			support.DeleteSecret("helm-optimize-plugin")
+			support.CheckError("", support.ClearConfig("helm-optimize-plugin"), false)
+			os.Exit(0)
+		}
+
+		//check if user is showing the effective config
+		if args[1] == "--show-config" {
+			showConfig()
 			os.Exit(0)
 		}
 
@@ -211,43 +485,102 @@ func processPluginSwitches(args []string) {
 
 		support.PrintCharAcrossScreen("-")
 		fmt.Println("LOCAL CLUSTER: " + localCluster)
+		fmt.Println("PROFILE: " + support.ProfileName())
 		fmt.Println("REMOTE CLUSTER: " + remoteCluster)
+		for _, rule := range lookupRules {
+			fmt.Println("  MAPPING: " + rule.String() + " (lookups only)")
+		}
 		fmt.Println("ADAPTER: " + adapter)
 
+		if len(args) > 2 && !strings.HasPrefix(args[1], "-") {
+			releaseName = args[1]
+		}
+
 		for _, manifest := range strings.Split(stdOut, "---") {
 
-			objType, objName, objNamespace, containers, _, err := validateManifest([]byte(manifest))
+			objType, objName, objNamespace, _, containers, manifestMap, err := validateManifest([]byte(manifest))
 			if err != nil {
 				continue
 			}
+			setReleaseContext(releaseName, sourceChart(manifest))
 
 			fmt.Println("\nnamespace[" + objNamespace + "] objType[" + objType + "] objName[" + objName + "]")
+			aliasName := workloadAlias(objName, manifestLabels(manifestMap))
+			if aliasName != objName {
+				fmt.Println("alias[" + aliasName + "]")
+			}
 			for i, container := range containers {
 
 				containerName := container.(map[string]interface{})["name"].(string)
-				approvalSetting, err := getApprovalSetting(remoteCluster, objNamespace, objType, objName, containerName)
+				approvalSetting, err := getApprovalSetting(remoteCluster, objNamespace, objType, aliasName, containerName)
 				if err != nil {
 					fmt.Println(strconv.Itoa(i+1) + "." + containerName + " not found in repository.")
 					continue
 				}
-				fmt.Print(strconv.Itoa(i+1) + "." + containerName + " [" + approvalSetting + "] ")
-				var approval string
-				if approvalSetting == "Not Approved" {
-					fmt.Print("Approve this insight (y/n) [y]: ")
-					fmt.Scanln(&approval)
-					if approval == "y" || approval == "" {
-						if err := updateApprovalSetting(true, remoteCluster, objNamespace, objType, objName, containerName); err != nil {
-							fmt.Print("  " + err.Error())
-						}
-					}
+				fmt.Println(strconv.Itoa(i+1) + "." + containerName + " [" + approvalSetting + "]")
+				if err := selectApprovalSetting(objNamespace, objType, aliasName, containerName); err != nil {
+					fmt.Println("  " + err.Error())
+				}
+
+			}
+		}
+
+		support.PrintCharAcrossScreen("-")
+		os.Exit(0)
+
+	}
+
+	if args[0] == "-s" && len(args) == 2 && args[1] == "--from-densify" {
+		syncFromDensify()
+		os.Exit(0)
+	}
+
+	if args[0] == "-s" && len(args) > 1 {
+
+		if err := initializeAdapter(); err != nil {
+			os.Exit(0)
+		}
+
+		var workloads []workload
+		var err error
+		if args[1] == "--namespace" && len(args) == 3 {
+			workloads, err = listWorkloads(args[2])
+		} else {
+			workloads, err = renderWorkloads(args[1:])
+		}
+		support.CheckError("", err, true)
+
+		support.PrintCharAcrossScreen("-")
+		fmt.Println("LOCAL CLUSTER: " + localCluster)
+		fmt.Println("PROFILE: " + support.ProfileName())
+		fmt.Println("REMOTE CLUSTER: " + remoteCluster)
+		for _, rule := range lookupRules {
+			fmt.Println("  MAPPING: " + rule.String() + " (lookups only)")
+		}
+		fmt.Println("ADAPTER: " + adapter)
+
+		for _, w := range workloads {
+
+			setReleaseContext(w.release, w.chart)
+			fmt.Println("\nnamespace[" + w.namespace + "] objType[" + w.objType + "] objName[" + w.objName + "]")
+			if w.alias != w.objName {
+				fmt.Println("alias[" + w.alias + "]")
+			}
+			for i, containerName := range w.containers {
+
+				fmt.Print(strconv.Itoa(i+1) + "." + containerName + ": ")
+				resources, err := extractResourceSpecFromK8S(remoteCluster, w.namespace, w.objType, w.objName, containerName)
+				if err != nil {
+					fmt.Println(strings.TrimSpace(err.Error()))
+					continue
+				}
+				created, err := seedParameter(remoteCluster, w.namespace, w.objType, w.alias, containerName, resources)
+				if err != nil {
+					fmt.Println(err)
+				} else if created {
+					fmt.Println("created " + fmt.Sprint(resources))
 				} else {
-					fmt.Print("Unapprove this insight (y/n) [y]: ")
-					fmt.Scanln(&approval)
-					if approval == "y" || approval == "" {
-						if err := updateApprovalSetting(false, remoteCluster, objNamespace, objType, objName, containerName); err != nil {
-							fmt.Print("  " + err.Error())
-						}
-					}
+					fmt.Println("already exists")
 				}
 
 			}
@@ -259,13 +592,118 @@ func processPluginSwitches(args []string) {
 	}
 
 	//Check for errors
-	if args[0] == "-c" || args[0] == "-a" {
+	if args[0] == "-c" || args[0] == "-a" || args[0] == "-s" {
 		fmt.Println("incorrect optimize-plugin command - refer to help menu")
 		os.Exit(0)
 	}
 
 }
 
+func processProfileSwitches(args []string) {
+
+	//a mistyped --profile or HELM_OPTIMIZE_PROFILE would otherwise run against an empty profile, new profiles are only created with -p --create
+	if len(args) == 0 || args[0] != "-p" {
+		if (profileName != "" || os.Getenv("HELM_OPTIMIZE_PROFILE") != "") && !support.ProfileExists("helm-optimize-plugin", support.ProfileName()) {
+			fmt.Println("profile [" + support.ProfileName() + "] does not exist - use 'helm optimize -p --create " + support.ProfileName() + "' to create it")
+			os.Exit(1)
+		}
+		return
+	}
+
+	//Check if user is listing profiles
+	if len(args) == 2 && args[1] == "--list" {
+		contexts := support.ProfileContexts("helm-optimize-plugin")
+		support.PrintCharAcrossScreen("-")
+		for _, name := range support.ListProfiles("helm-optimize-plugin") {
+			var mapped []string
+			for context, profile := range contexts {
+				if profile == name {
+					mapped = append(mapped, context)
+				}
+			}
+			sort.Strings(mapped)
+			line := "  " + name
+			if name == support.ProfileName() {
+				line = "* " + name
+			}
+			if len(mapped) > 0 {
+				line += " [" + strings.Join(mapped, ", ") + "]"
+			}
+			fmt.Println(line)
+		}
+		support.PrintCharAcrossScreen("-")
+		os.Exit(0)
+	}
+
+	if len(args) == 3 {
+
+		exists := support.ProfileExists("helm-optimize-plugin", args[2])
+
+		//Check if user is creating a profile
+		if args[1] == "--create" {
+			if exists {
+				fmt.Println("profile [" + args[2] + "] already exists - use 'helm optimize --profile " + args[2] + " -c --adapter' to reconfigure it")
+				os.Exit(0)
+			}
+			support.CheckError("", support.SelectProfile(args[2], kubeContext, "helm-optimize-plugin"), true)
+			selectRemoteCluster()
+			selectAdapter()
+			//a half created profile would block the name, so its keys are removed if the adapter can't be set up
+			if err := initializeAdapter(); err != nil {
+				support.CheckError("", support.ClearConfig("helm-optimize-plugin"), true)
+				fmt.Println("profile [" + args[2] + "] not created")
+				os.Exit(0)
+			}
+			fmt.Println("profile [" + args[2] + "] created - use 'helm optimize -p --switch " + args[2] + "' to use it in context [" + kubeContext + "]")
+			os.Exit(0)
+		}
+
+		//Check if user is switching the profile of the current context
+		if args[1] == "--switch" {
+			if !exists {
+				fmt.Println("profile [" + args[2] + "] does not exist - use 'helm optimize -p --create " + args[2] + "' to create it")
+				os.Exit(0)
+			}
+			support.CheckError("", support.SetProfileContext("helm-optimize-plugin", kubeContext, args[2]), true)
+			fmt.Println("context [" + kubeContext + "] now uses profile [" + args[2] + "]")
+			os.Exit(0)
+		}
+
+		//Check if user is deleting a profile
+		if args[1] == "--delete" {
+			support.CheckError("", support.DeleteProfile("helm-optimize-plugin", args[2]), true)
+			fmt.Println("profile [" + args[2] + "] deleted")
+			os.Exit(0)
+		}
+
+	}
+
+	fmt.Println("incorrect optimize-plugin command - refer to help menu")
+	os.Exit(0)
+
+}
+
+func showConfig() {
+
+	values, sources := support.ResolveConfig("helm-optimize-plugin")
+
+	support.PrintCharAcrossScreen("-")
+	fmt.Println("PROFILE: " + support.ProfileName())
+	fmt.Println("CONFIG STORE: " + support.ConfigStore)
+	fmt.Println("CONFIG FILE: " + support.ConfigFile)
+	fmt.Println("PRECEDENCE: flag > env > file > secret")
+	fmt.Println("")
+	for _, key := range support.SortedConfigKeys(values) {
+		value := values[key]
+		if _, ok := support.InSlice(secretConfigKeys, key); ok && value != "" {
+			value = "********"
+		}
+		fmt.Println(key + ": " + value + " [" + sources[key] + "]")
+	}
+	support.PrintCharAcrossScreen("-")
+
+}
+
 func printHowToUse() error {
 
 	content, err := ioutil.ReadFile(os.Getenv("HELM_PLUGIN_DIR") + "/plugin.yaml")
@@ -373,46 +811,146 @@ func scanFlagsForChartDetails(args []string) (string, int, error) {
 
 }
 
-func main() {
-
-	startTime := time.Now()
+func extractPluginFlags(args []string) ([]string, error) {
 
-	//set environment variables
-	args := os.Args[1:]
+	helmArgs, err := extractFlags(args, pluginFlags)
+	if err != nil {
+		return nil, err
+	}
+	if len(helmArgs) > 0 {
+		if _, ok := support.InSlice(optimizedCommands, helmArgs[0]); ok {
+			if helmArgs, err = extractFlags(helmArgs, chartFlags); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	if !(len(args) == 1 && args[0] == "-h") {
-		checkGeneralDependancies()
-		interpolateContext()
+	if resizePolicyMode != "" && resizePolicyMode != "honour" && resizePolicyMode != "add" {
+		return nil, errors.New("--resize-policy must be one of [honour, add]")
 	}
-	processPluginSwitches(args)
 
-	//initialize the adapter
-	if adapter == "" {
-		if err := initializeAdapter(); err != nil {
-			os.Exit(0)
+	if adapterOverride != "" {
+		var names []string
+		for i := 1; i <= len(availableAdapters); i++ {
+			names = append(names, availableAdapters[i])
+		}
+		if _, ok := support.InSlice(names, adapterOverride); !ok {
+			return nil, errors.New("--use-adapter must be one of [" + strings.Join(names, ", ") + "]")
 		}
 	}
 
-	//if helm command is not install, upgrade, then just pass along to helm.
-	if args[0] != "install" && args[0] != "upgrade" && args[0] != "template" {
+	if parsedSelector, err = support.ParseSelector(labelSelector); err != nil {
+		return nil, errors.New("--selector is invalid: " + err.Error())
+	}
 
-		stdOut, stdErr, err := support.ExecuteSingleCommand(append([]string{HelmBin}, args...))
-		support.CheckError(stdErr, err, true)
-		fmt.Println(stdOut)
-		os.Exit(0)
+	return helmArgs, nil
 
-	} else {
+}
 
-		//validate whether the command is legal
-		_, stdErr, err := support.ExecuteSingleCommand(append(append([]string{HelmBin}, args...), "--dry-run"))
-		support.CheckError(stdErr, err, true)
+//extractFlags removes the given flags (--flag value or --flag=value) from the args and stores their values
+func extractFlags(args []string, flags map[string]*string) ([]string, error) {
 
-		chart, argPos, err := scanFlagsForChartDetails(os.Args[1:])
+	var remaining []string
+	for i := 0; i < len(args); i++ {
+
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = args[i][:idx], args[i][idx+1:]
+		}
+
+		target, ok := flags[flag]
+		if !ok {
+			remaining = append(remaining, args[i])
+			continue
+		}
+
+		if value == "" {
+			if i+1 >= len(args) {
+				return nil, errors.New("flag " + flag + " requires a value")
+			}
+			i++
+			value = args[i]
+		}
+		*target = value
+
+	}
+
+	return remaining, nil
+
+}
+
+func main() {
+
+	startTime := time.Now()
+
+	//set environment variables
+	args, err := extractPluginFlags(os.Args[1:])
+	support.CheckError("", err, true)
+
+	//resolve the config store, flags take precedence over every other config source
+	support.CheckError("", support.InitConfig(configPath, configStore), true)
+	if adapterOverride != "" {
+		support.SetConfigOverride("adapter", adapterOverride)
+	}
+	if remoteClusterOverride != "" {
+		support.SetConfigOverride("remoteCluster", remoteClusterOverride)
+	}
+
+	if !(len(args) == 1 && args[0] == "-h") {
+		checkGeneralDependancies()
+		interpolateContext()
+		processProfileSwitches(args)
+		resolveRemoteCluster()
+		loadAliases()
+	}
+	processPluginSwitches(args)
+
+	//initialize the adapter
+	if adapter == "" {
+		if err := initializeAdapter(); err != nil {
+			os.Exit(0)
+		}
+	}
+
+	//if helm command is not install, upgrade, then just pass along to helm.
+	if args[0] != "install" && args[0] != "upgrade" && args[0] != "template" {
+
+		stdOut, stdErr, err := support.ExecuteSingleCommand(append([]string{HelmBin}, args...))
+		support.CheckError(stdErr, err, true)
+		fmt.Println(stdOut)
+		os.Exit(0)
+
+	} else {
+
+		//validate whether the command is legal
+		_, stdErr, err := support.ExecuteSingleCommand(append(append([]string{HelmBin}, args...), "--dry-run"))
+		support.CheckError(stdErr, err, true)
+
+		chart, argPos, err := scanFlagsForChartDetails(args)
 		support.CheckError("", err, true)
+		if argPos > 1 && !strings.HasPrefix(args[1], "-") {
+			releaseName = args[1]
+		}
+
+		//load user policy
+		if userPolicyPath != "" && !support.FileExists(userPolicyPath) {
+			support.CheckError("", errors.New("policy file '"+userPolicyPath+"' does not exist"), true)
+		} else if userPolicyPath == "" && os.Getenv("HELM_CONFIG_HOME") != "" {
+			userPolicyPath = os.Getenv("HELM_CONFIG_HOME") + "/optimize/policy.yaml"
+		}
+		userPolicy = &policy.Policy{}
+		if userPolicyPath != "" {
+			userPolicy, err = policy.Load(userPolicyPath)
+			support.CheckError("", err, true)
+		}
 
 		support.PrintCharAcrossScreen("-")
 		fmt.Println("LOCAL CLUSTER: " + localCluster)
+		fmt.Println("PROFILE: " + support.ProfileName())
 		fmt.Println("REMOTE CLUSTER: " + remoteCluster)
+		for _, rule := range lookupRules {
+			fmt.Println("  MAPPING: " + rule.String())
+		}
 		fmt.Println("ADAPTER: " + adapter + "\n")
 
 		absChartPath, _ := filepath.Abs(chart)
@@ -449,7 +987,12 @@ func main() {
 			support.CheckError(stdErr, err, true)
 		}
 
-		processChart(tempChartDir+"/"+chartDirName, args)
+		//a chart that can't be processed (eg. an invalid policy) is never handed to helm
+		if err := processChart(tempChartDir+"/"+chartDirName, args); err != nil {
+			support.ExecuteSingleCommand([]string{"rm", "-rf", tempChartDir})
+			support.CheckError("unable to optimize the chart - helm "+args[0]+" not run", err, true)
+		}
+		printResizeReport()
 
 		fmt.Printf("EXECUTION TIME: %.2fs\n", time.Now().Sub(startTime).Seconds())
 		support.PrintCharAcrossScreen("-")
@@ -459,6 +1002,9 @@ func main() {
 		support.CheckError(stdErr, err, false)
 		if err == nil {
 			fmt.Println(stdOut)
+			if args[0] != "template" && !dryRun(args) {
+				recordDeployments(stdOut)
+			}
 		}
 
 		//delete temporary chart directory
@@ -468,15 +1014,221 @@ func main() {
 	}
 }
 
+//dryRun checks whether the helm command is a dry run (--dry-run, --dry-run=client or --dry-run=server)
+func dryRun(args []string) bool {
+
+	for _, arg := range args {
+		if arg == "--dry-run" {
+			return true
+		}
+		if strings.HasPrefix(arg, "--dry-run=") {
+			value := strings.TrimPrefix(arg, "--dry-run=")
+			return value != "false" && value != "none"
+		}
+	}
+
+	return false
+
+}
+
+func recordDeployments(helmOutput string) {
+
+	if len(appliedInsights) == 0 {
+		return
+	}
+
+	//release name and revision are reported by helm install/upgrade
+	var release, revision string
+	for _, line := range strings.Split(helmOutput, "\n") {
+		if strings.HasPrefix(line, "NAME:") {
+			release = strings.TrimSpace(strings.TrimPrefix(line, "NAME:"))
+		} else if strings.HasPrefix(line, "REVISION:") {
+			revision = strings.TrimSpace(strings.TrimPrefix(line, "REVISION:"))
+		}
+	}
+	if release == "" || revision == "" {
+		return
+	}
+
+	deployedAt := time.Now()
+	for _, applied := range appliedInsights {
+		if err := recordDeployment(remoteCluster, applied["namespace"], applied["objType"], applied["objName"], applied["containerName"], release, revision, deployedAt, applied["deviations"]); err != nil {
+			fmt.Println("namespace[" + applied["namespace"] + "] objType[" + applied["objType"] + "] objName[" + applied["objName"] + "] container[" + applied["containerName"] + "]: " + err.Error())
+		}
+	}
+
+}
+
+//syncFromDensify mirrors the densify recommendations of the remote cluster into parameter store
+func syncFromDensify() {
+
+	support.CheckError("", densify.Load(), true)
+	support.CheckError("", ssm.Load(), true)
+
+	recommendations, unresolved, err := densify.Recommendations(remoteCluster)
+	support.CheckError("", err, true)
+
+	support.PrintCharAcrossScreen("-")
+	fmt.Println("LOCAL CLUSTER: " + localCluster)
+	fmt.Println("PROFILE: " + support.ProfileName())
+	fmt.Println("REMOTE CLUSTER: " + remoteCluster)
+	fmt.Println("SYNC: Densify -> Parameter Store")
+	fmt.Println("")
+
+	counts := make(map[string]int)
+	for _, r := range recommendations {
+		status, err := ssm.SyncParameter(remoteCluster, r.Namespace, r.ObjType, r.ObjName, r.Container, r.Current, r.Recommended, r.ApprovalSetting != "Not Approved")
+		if err != nil {
+			status = "failed"
+		}
+		counts[status]++
+		if status != "unchanged" {
+			line := "namespace[" + r.Namespace + "] objType[" + r.ObjType + "] objName[" + r.ObjName + "] container[" + r.Container + "]: " + status + " [" + r.ApprovalSetting + "]"
+			if err != nil {
+				line += " " + err.Error()
+			}
+			fmt.Println(line)
+		}
+	}
+	for _, reason := range unresolved {
+		fmt.Println("unresolved " + reason)
+	}
+
+	fmt.Println("\nCreated: " + strconv.Itoa(counts["created"]) + "  Updated: " + strconv.Itoa(counts["updated"]) + "  Unchanged: " + strconv.Itoa(counts["unchanged"]) + "  Failed: " + strconv.Itoa(counts["failed"]) + "  Unresolved: " + strconv.Itoa(len(unresolved)))
+	support.PrintCharAcrossScreen("-")
+
+}
+
+//workload identifies the containers of a workload to seed
+type workload struct {
+	namespace  string
+	objType    string
+	objName    string
+	alias      string
+	release    string
+	chart      string
+	containers []string
+}
+
+//renderWorkloads renders a chart (helm template args) and returns its workloads
+func renderWorkloads(args []string) ([]workload, error) {
+
+	stdOut, stdErr, err := support.ExecuteSingleCommand(append([]string{HelmBin, "template"}, args...))
+	if err != nil {
+		return nil, errors.New(stdErr)
+	}
+
+	var release string
+	if len(args) > 1 && !strings.HasPrefix(args[0], "-") {
+		release = args[0]
+	}
+
+	var workloads []workload
+	for _, manifest := range strings.Split(stdOut, "---") {
+
+		objType, objName, objNamespace, _, containers, manifestMap, err := validateManifest([]byte(manifest))
+		if err != nil {
+			continue
+		}
+
+		w := workload{namespace: objNamespace, objType: objType, objName: objName, alias: workloadAlias(objName, manifestLabels(manifestMap)), release: release, chart: sourceChart(manifest)}
+		for _, container := range containers {
+			if containerName := support.CheckMap(container.(map[string]interface{}), "name"); containerName != "" {
+				w.containers = append(w.containers, containerName)
+			}
+		}
+		workloads = append(workloads, w)
+
+	}
+
+	return workloads, nil
+
+}
+
+//listWorkloads returns the workloads running in a namespace.  Pods, ReplicaSets and Jobs are skipped as they are usually managed by another workload.
+func listWorkloads(objNamespace string) ([]workload, error) {
+
+	var workloads []workload
+	for _, objType := range []string{"CronJob", "DaemonSet", "Deployment", "ReplicationController", "StatefulSet"} {
+
+		containerPath := strings.Trim(objTypeContainerPath[objType], "{}")
+		jsonPath := `{range .items[*]}{.metadata.name}{"\t"}{.metadata.annotations.meta\.helm\.sh/release-name}{"\t"}{` + containerPath + `[*].name}{"\t"}` +
+			`{.metadata.labels.app\.kubernetes\.io/name}{"\t"}{.metadata.labels.app\.kubernetes\.io/component}{"\n"}{end}`
+
+		stdOut, stdErr, err := support.ExecuteSingleCommand([]string{KubectlBin, "get", objType, "-o=jsonpath=" + jsonPath, "--cluster=" + remoteCluster, "--namespace=" + objNamespace})
+		if err != nil {
+			return nil, errors.New(stdErr)
+		}
+
+		for _, line := range strings.Split(stdOut, "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) != 5 || fields[0] == "" {
+				continue
+			}
+			labels := map[string]string{"app.kubernetes.io/name": fields[3], "app.kubernetes.io/component": fields[4]}
+			workloads = append(workloads, workload{namespace: objNamespace, objType: objType, objName: fields[0], alias: workloadAlias(fields[0], labels), release: fields[1], containers: strings.Fields(fields[2])})
+		}
+
+	}
+
+	return workloads, nil
+
+}
+
+//sourceChart returns the name of the chart a manifest rendered by helm template originates from (ie. the '# Source: chart/templates/...' comment)
+func sourceChart(manifest string) string {
+
+	for _, line := range strings.Split(manifest, "\n") {
+		if strings.HasPrefix(line, "# Source: ") {
+			path := strings.Split(strings.TrimPrefix(line, "# Source: "), "/")
+			//subcharts are rendered as chart/charts/subchart/templates/...
+			for i := 1; i < len(path); i++ {
+				if path[i] == "templates" {
+					return path[i-1]
+				}
+			}
+		}
+	}
+
+	return ""
+
+}
+
+//deviations lists the deployed quantities that differ from the recommendation (eg. changed by the fields annotation or the chart policy)
+func deviations(recommended map[string]map[string]string, deployed map[string]map[string]string) []string {
+
+	var changes []string
+	for _, field := range []string{"requests", "limits"} {
+		for _, resource := range []string{"cpu", "memory"} {
+			recommendedQuantity, ok := recommended[field][resource]
+			if !ok {
+				continue
+			}
+			deployedQuantity, ok := deployed[field][resource]
+			if !ok {
+				changes = append(changes, field+"."+resource+"=none (recommended "+recommendedQuantity+")")
+				continue
+			}
+			recommendedVal, err1 := support.ParseQuantity(recommendedQuantity)
+			deployedVal, err2 := support.ParseQuantity(deployedQuantity)
+			if err1 != nil || err2 != nil || recommendedVal != deployedVal {
+				changes = append(changes, field+"."+resource+"="+deployedQuantity+" (recommended "+recommendedQuantity+")")
+			}
+		}
+	}
+
+	return changes
+
+}
+
 func processChart(chartPath string, args []string) error {
 
 	objs, err := ioutil.ReadDir(chartPath)
 	if err == nil {
 		for _, obj := range objs {
 			if obj.IsDir() {
-				err := processChart(chartPath+"/"+obj.Name(), args)
-				if err != nil {
-					fmt.Println(err)
+				if err := processChart(chartPath+"/"+obj.Name(), args); err != nil {
+					return err
 				}
 			}
 		}
@@ -491,7 +1243,8 @@ func processChart(chartPath string, args []string) error {
 	//unmarshal Chart.yaml to check whether it's a valid yaml file
 	var chartStruct map[string]interface{}
 	if err := yaml.Unmarshal(chartFileContents, &chartStruct); err != nil {
-		return errors.New("'Chart.yaml' not a valid yaml file")
+		fmt.Print("'Chart.yaml' not a valid yaml file - skipping\n\n")
+		return nil
 	}
 
 	//if Chart.yaml has a name field, then print chart name
@@ -499,19 +1252,33 @@ func processChart(chartPath string, args []string) error {
 		printData := "CHART: " + chartStruct["name"].(string)
 		fmt.Println(printData + "\n" + strings.Repeat("=", len(printData)))
 	} else {
-		return errors.New("'Chart.yaml' does not contain name field")
+		fmt.Print("'Chart.yaml' does not contain name field - skipping\n\n")
+		return nil
 	}
 
+	setReleaseContext(releaseName, chartStruct["name"].(string))
+
+	//merge the policy shipped with the chart with the user policy
+	chartPolicy, err := policy.Load(chartPath + "/" + policy.FileName)
+	if err != nil {
+		return errors.New("chart [" + chartStruct["name"].(string) + "]: " + err.Error())
+	}
+	chartPolicy = chartPolicy.Merge(userPolicy)
+
 	//if templates directory exists, then process all files in that directory
 	if support.DirExists(chartPath + "/templates") {
-		return processTemplates(chartPath+"/templates", args)
+		valuesOverrides = make(map[string]interface{})
+		err := processTemplates(chartPath+"/templates", args, chartPolicy)
+		printValuesOverrides(chartStruct["name"].(string))
+		return err
 	}
 
-	return errors.New("templates directory doesn't exist for this chart - skipping\n\n")
+	fmt.Print("templates directory doesn't exist for this chart - skipping\n\n")
+	return nil
 
 }
 
-func processTemplates(templatePath string, args []string) error {
+func processTemplates(templatePath string, args []string, chartPolicy *policy.Policy) error {
 
 	templates, err := ioutil.ReadDir(templatePath)
 	if err != nil {
@@ -522,7 +1289,7 @@ func processTemplates(templatePath string, args []string) error {
 
 		if template.IsDir() {
 
-			processTemplates(templatePath+"/"+template.Name(), args)
+			processTemplates(templatePath+"/"+template.Name(), args, chartPolicy)
 
 		} else {
 
@@ -531,12 +1298,29 @@ func processTemplates(templatePath string, args []string) error {
 				continue
 			}
 
-			objType, objName, objNamespace, containers, manifestMap, err := validateManifest(manifest)
+			objType, objName, objNamespace, podSpec, containers, manifestMap, err := validateManifest(manifest)
 			if err != nil {
 				continue
 			}
 
+			if reason := outOfScope(objNamespace, objType, manifestMap); reason != "" {
+				fmt.Println("namespace[" + objNamespace + "] objType[" + objType + "] objName[" + objName + "]: skipped (" + reason + ")\n")
+				continue
+			}
+
 			fmt.Println("namespace[" + objNamespace + "] objType[" + objType + "] objName[" + objName + "]")
+			aliasName := workloadAlias(objName, manifestLabels(manifestMap))
+			lookupCluster, lookupNamespace, lookupName, mapped := mapLookup(objNamespace, aliasName)
+			if mapped || aliasName != objName {
+				fmt.Println("lookup: cluster[" + lookupCluster + "] namespace[" + lookupNamespace + "] objName[" + lookupName + "]")
+			}
+
+			//the running spec is read from the workload itself, unless a mapping rule redirects it
+			specName := objName
+			if mapped {
+				specName = lookupName
+			}
+			annotations := readOptimizeAnnotations(objType, manifestMap)
 			var i int = 1
 			for _, container := range containers {
 
@@ -547,26 +1331,68 @@ func processTemplates(templatePath string, args []string) error {
 
 				fmt.Print(strconv.Itoa(i) + "." + containerName + ": ")
 
+				//honour per-container annotations and chart policy
+				if !containerSelected(annotations, containerName) {
+					fmt.Println("skipped by annotation")
+					i++
+					continue
+				}
+				if chartPolicy.Excluded(containerName) {
+					fmt.Println("skipped by policy")
+					i++
+					continue
+				}
+				fields, err := optimizeFields(annotations, containerName)
+				if err != nil {
+					fmt.Println("skipped - " + err.Error())
+					i++
+					continue
+				}
+
 				//try to get recommendation from repo
-				insight, approvalSetting, err := getInsight(remoteCluster, objNamespace, objType, objName, containerName)
+				insight, approvalSetting, err := getInsight(lookupCluster, lookupNamespace, objType, lookupName, containerName)
+				//the audit metadata is only needed by a confidence policy, or to show how densify resolved multiple results
+				var meta support.InsightMeta
+				var metaErr error
+				if err == nil && (chartPolicy.Gated() || adapter == "Densify") {
+					meta, metaErr = getInsightMeta(lookupCluster, lookupNamespace, objType, lookupName, containerName)
+				}
+				if err == nil && approvalSetting != "Not Approved" && chartPolicy.Gated() {
+					//a recommendation that can't be checked against the confidence policy is never applied
+					if metaErr != nil {
+						err = errors.New("[" + approvalSetting + "] recommendation skipped - confidence metadata unavailable (" + metaErr.Error() + ")")
+					} else if reason := chartPolicy.Gate(meta); reason != "" {
+						err = errors.New("[" + approvalSetting + "] recommendation skipped - " + reason)
+					}
+				}
 				if err != nil {
 					fmt.Println(err)
 				} else {
 					fmt.Print("[" + approvalSetting + "] ")
 					fmt.Println(insight)
-					container.(map[string]interface{})["resources"] = insight
+					if metaErr == nil && meta.Resolution != "" {
+						fmt.Println("  Resolved multiple results by: " + meta.Resolution)
+					}
+					resources := applyPolicy(chartPolicy, container.(map[string]interface{}), insight, fields)
+					//deployments are only recorded against the workload's own recommendation
+					if approvalSetting != "Not Approved" && !mapped {
+						appliedInsights = append(appliedInsights, map[string]string{"namespace": objNamespace, "objType": objType, "objName": aliasName, "containerName": containerName, "deviations": strings.Join(deviations(insight, resources), ", ")})
+					}
+					if resizePolicyMode != "" {
+						processResizePolicy(container.(map[string]interface{}), objNamespace, objType, objName, resources)
+					}
 					i++
 					continue
 				}
 
 				//try to get recommendation from k8s
 				fmt.Print("  Checking Cluster: ")
-				insight, err = extractResourceSpecFromK8S(remoteCluster, objNamespace, objType, objName, containerName)
+				insight, err = extractResourceSpecFromK8S(lookupCluster, lookupNamespace, objType, specName, containerName)
 				if err != nil {
 					fmt.Println(err)
 				} else {
 					fmt.Println(insight)
-					container.(map[string]interface{})["resources"] = insight
+					applyPolicy(chartPolicy, container.(map[string]interface{}), insight, fields)
 					i++
 					continue
 				}
@@ -577,6 +1403,7 @@ func processTemplates(templatePath string, args []string) error {
 				if val, ok := container.(map[string]interface{})["resources"].(map[string]interface{}); ok && len(val) > 0 {
 					defaultConfig = container.(map[string]interface{})["resources"].(map[string]interface{})
 					fmt.Println(defaultConfig)
+					applyPolicy(chartPolicy, container.(map[string]interface{}), support.ResourceMap(defaultConfig), fields)
 				} else {
 					fmt.Println("*WARNING* No default config present!")
 				}
@@ -585,6 +1412,8 @@ func processTemplates(templatePath string, args []string) error {
 
 			}
 
+			processPodResources(objNamespace, objType, objName, aliasName, podSpec, containers)
+
 			manifestYAMLStr, err := yaml.Marshal(manifestMap)
 			support.CheckError("", err, true)
 			err = ioutil.WriteFile(templatePath+"/"+template.Name(), manifestYAMLStr, 0644)
@@ -598,21 +1427,39 @@ func processTemplates(templatePath string, args []string) error {
 
 }
 
-func validateManifest(manifest []byte) (string, string, string, []interface{}, map[string]interface{}, error) {
+//applyPolicy merges the resources into the container's own, enforces the chart policy on the result and writes it to the container (and its values path, if mapped).
+func applyPolicy(chartPolicy *policy.Policy, container map[string]interface{}, insight map[string]map[string]string, fields []string) map[string]map[string]string {
+
+	containerName := container["name"].(string)
+	existing := support.ResourceMap(container["resources"])
+	resources, notes := chartPolicy.Apply(containerName, existing, mergeResources(existing, insight, fields))
+	for _, note := range notes {
+		fmt.Println("  Policy: " + note)
+	}
+	if path, ok := chartPolicy.ValuesPath(containerName); ok {
+		setValuesPath(valuesOverrides, path, resources)
+	}
+	container["resources"] = resources
+
+	return resources
+
+}
+
+func validateManifest(manifest []byte) (string, string, string, map[string]interface{}, []interface{}, map[string]interface{}, error) {
 
 	var manifestMap map[string]interface{}
 	if err := yaml.Unmarshal(manifest, &manifestMap); err != nil {
-		return "", "", "", nil, nil, errors.New("unable to unmarshal manifest")
+		return "", "", "", nil, nil, nil, errors.New("unable to unmarshal manifest")
 	}
 
 	var objType, objName, objNamespace string
 
 	if objType = support.CheckMap(manifestMap, "kind"); objType == "" {
-		return "", "", "", nil, nil, errors.New("manifest does not contain valid k8s objType")
+		return "", "", "", nil, nil, nil, errors.New("manifest does not contain valid k8s objType")
 	}
 
 	if objName = support.CheckMap(manifestMap, "metadata", "name"); objName == "" {
-		return "", "", "", nil, nil, errors.New("manifest does not contain valid k8s objName")
+		return "", "", "", nil, nil, nil, errors.New("manifest does not contain valid k8s objName")
 	}
 
 	if objNamespace = support.CheckMap(manifestMap, "metadata", "namespace"); objNamespace == "" {
@@ -620,24 +1467,517 @@ func validateManifest(manifest []byte) (string, string, string, []interface{}, m
 	}
 
 	if _, ok := objTypeContainerPath[objType]; !ok {
-		return "", "", "", nil, nil, errors.New("manifest contains objType that's not supported")
+		return "", "", "", nil, nil, nil, errors.New("manifest contains objType that's not supported")
 	}
 
 	if val := support.CheckMap(manifestMap, "metadata", "annotations", "helm.sh/hook"); strings.HasPrefix(val, "test") {
-		return "", "", "", nil, nil, errors.New("manifest is for helm test pod")
+		return "", "", "", nil, nil, nil, errors.New("manifest is for helm test pod")
+	}
+
+	if val := readOptimizeAnnotations(objType, manifestMap)["helm-optimize/skip"]; val == "true" {
+		return "", "", "", nil, nil, nil, errors.New("manifest opted out of optimization")
 	}
 
-	var containers []interface{}
+	var podSpec map[string]interface{}
 	switch objType {
 	case "Pod":
-		containers = manifestMap["spec"].(map[string]interface{})["containers"].([]interface{})
+		podSpec = manifestMap["spec"].(map[string]interface{})
 	case "CronJob":
-		containers = manifestMap["spec"].(map[string]interface{})["jobTemplate"].(map[string]interface{})["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})
+		podSpec = manifestMap["spec"].(map[string]interface{})["jobTemplate"].(map[string]interface{})["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
 	default:
-		containers = manifestMap["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})
+		podSpec = manifestMap["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+	}
+
+	containers, ok := podSpec["containers"].([]interface{})
+	if !ok {
+		return "", "", "", nil, nil, nil, errors.New("manifest does not contain any containers")
+	}
+
+	if val, ok := podSpec["resources"]; ok {
+		if _, ok := val.(map[string]interface{}); !ok {
+			return "", "", "", nil, nil, nil, errors.New("manifest contains invalid pod-level resources")
+		}
 	}
 
-	return objType, objName, objNamespace, containers, manifestMap, nil
+	return objType, objName, objNamespace, podSpec, containers, manifestMap, nil
+
+}
+
+func outOfScope(objNamespace string, objType string, manifestMap map[string]interface{}) string {
+
+	if onlyNamespaces != "" {
+		if _, found := support.InSlice(splitList(onlyNamespaces), objNamespace); !found {
+			return "namespace not in --only-namespaces"
+		}
+	}
+
+	if excludeKinds != "" {
+		if _, found := support.InSlice(splitList(excludeKinds), objType); found {
+			return "kind in --exclude-kinds"
+		}
+	}
+
+	if labelSelector != "" {
+		if !parsedSelector.Matches(manifestLabels(manifestMap)) {
+			return "labels do not match --selector"
+		}
+	}
+
+	return ""
+
+}
+
+func manifestLabels(manifestMap map[string]interface{}) map[string]string {
+
+	labels := make(map[string]string)
+	if metadata, ok := manifestMap["metadata"].(map[string]interface{}); ok {
+		if labelMap, ok := metadata["labels"].(map[string]interface{}); ok {
+			for key, val := range labelMap {
+				if strVal, ok := val.(string); ok {
+					labels[key] = strVal
+				}
+			}
+		}
+	}
+
+	return labels
+
+}
+
+//loadAliases loads the workload alias file and whether workloads are aliased by their labels.  A named profile uses its own
+//alias file (aliases.<profile>.yaml) when it exists, otherwise the alias file shared by every profile.
+func loadAliases() {
+
+	aliasLabels = support.RetrieveSecrets("helm-optimize-plugin")["workloadAlias"] == "labels"
+
+	if aliasFilePath != "" && !support.FileExists(aliasFilePath) {
+		support.CheckError("", errors.New("alias file '"+aliasFilePath+"' does not exist"), true)
+	} else if aliasFilePath == "" && os.Getenv("HELM_CONFIG_HOME") != "" {
+		aliasFilePath = os.Getenv("HELM_CONFIG_HOME") + "/optimize/aliases.yaml"
+		if profileFile := os.Getenv("HELM_CONFIG_HOME") + "/optimize/aliases." + support.ProfileName() + ".yaml"; support.ActiveProfile != "" && support.FileExists(profileFile) {
+			aliasFilePath = profileFile
+		}
+	}
+	if aliasFilePath == "" || !support.FileExists(aliasFilePath) {
+		return
+	}
+
+	content, err := ioutil.ReadFile(aliasFilePath)
+	support.CheckError("", err, true)
+	if err := yaml.Unmarshal(content, &workloadAliases); err != nil {
+		support.CheckError("", errors.New("'"+aliasFilePath+"' not a valid alias file"), true)
+	}
+	for pattern := range workloadAliases {
+		if _, err := path.Match(pattern, ""); err != nil {
+			support.CheckError("", errors.New("'"+aliasFilePath+"' contains invalid pattern ["+pattern+"]"), true)
+		}
+	}
+
+}
+
+//workloadAlias returns the name the workload is keyed by in the repository.  The alias file takes precedence (an exact name,
+//then the longest matching pattern), then the app.kubernetes.io/name and component labels (if enabled), otherwise the name itself.
+//Labels only alias Parameter Store keys, as densify only knows workloads by their name.
+func workloadAlias(objName string, labels map[string]string) string {
+
+	if alias, ok := workloadAliases[objName]; ok {
+		return alias
+	}
+
+	var matched string
+	for pattern := range workloadAliases {
+		if ok, _ := path.Match(pattern, objName); ok && (len(pattern) > len(matched) || (len(pattern) == len(matched) && pattern < matched)) {
+			matched = pattern
+		}
+	}
+	if matched != "" {
+		return workloadAliases[matched]
+	}
+
+	if aliasLabels && adapter == "Parameter Store" && labels["app.kubernetes.io/name"] != "" {
+		if component := labels["app.kubernetes.io/component"]; component != "" {
+			return labels["app.kubernetes.io/name"] + "-" + component
+		}
+		return labels["app.kubernetes.io/name"]
+	}
+
+	return objName
+
+}
+
+func readOptimizeAnnotations(objType string, manifestMap map[string]interface{}) map[string]string {
+
+	//workload annotations are overridden by pod template annotations
+	metadataList := []interface{}{manifestMap["metadata"]}
+	if spec, ok := manifestMap["spec"].(map[string]interface{}); ok {
+		switch objType {
+		case "Pod":
+		case "CronJob":
+			if jobTemplate, ok := spec["jobTemplate"].(map[string]interface{}); ok {
+				if jobSpec, ok := jobTemplate["spec"].(map[string]interface{}); ok {
+					if template, ok := jobSpec["template"].(map[string]interface{}); ok {
+						metadataList = append(metadataList, template["metadata"])
+					}
+				}
+			}
+		default:
+			if template, ok := spec["template"].(map[string]interface{}); ok {
+				metadataList = append(metadataList, template["metadata"])
+			}
+		}
+	}
+
+	annotations := make(map[string]string)
+	for _, metadata := range metadataList {
+		metadataMap, ok := metadata.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if annotationMap, ok := metadataMap["annotations"].(map[string]interface{}); ok {
+			for key, val := range annotationMap {
+				if strVal, ok := val.(string); ok && strings.HasPrefix(key, "helm-optimize/") {
+					annotations[key] = strings.TrimSpace(strVal)
+				}
+			}
+		}
+	}
+
+	return annotations
+
+}
+
+func containerSelected(annotations map[string]string, containerName string) bool {
+
+	if val, ok := annotations["helm-optimize/containers"]; ok {
+		if _, found := support.InSlice(splitList(val), containerName); !found {
+			return false
+		}
+	}
+
+	if val, ok := annotations["helm-optimize/exclude-containers"]; ok {
+		if _, found := support.InSlice(splitList(val), containerName); found {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+//optimizeFields returns the fields of the container to optimize, either a whole section (requests, limits) or a single resource (eg. limits.cpu).
+func optimizeFields(annotations map[string]string, containerName string) ([]string, error) {
+
+	val, ok := annotations["helm-optimize/fields."+containerName]
+	if !ok {
+		val, ok = annotations["helm-optimize/fields"]
+	}
+	if !ok || val == "" {
+		return []string{"requests", "limits"}, nil
+	}
+
+	//an unknown field would silently leave the container untouched (or fully optimized), so it is rejected
+	fields := splitList(val)
+	for _, field := range fields {
+		if _, ok := support.InSlice([]string{"requests", "limits", "requests.cpu", "requests.memory", "limits.cpu", "limits.memory"}, field); !ok {
+			return nil, errors.New("invalid helm-optimize/fields entry [" + field + "] - expected requests, limits or <requests|limits>.<cpu|memory>")
+		}
+	}
+
+	return fields, nil
+
+}
+
+func splitList(list string) []string {
+
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+
+}
+
+func mergeResources(existing interface{}, insight map[string]map[string]string, fields []string) map[string]map[string]string {
+
+	_, requests := support.InSlice(fields, "requests")
+	_, limits := support.InSlice(fields, "limits")
+	if requests && limits {
+		return insight
+	}
+
+	resources := support.ResourceMap(existing)
+	for _, field := range fields {
+		section, resource := field, ""
+		if idx := strings.Index(field, "."); idx >= 0 {
+			section, resource = field[:idx], field[idx+1:]
+		}
+		if _, ok := insight[section]; !ok {
+			continue
+		}
+		if resource == "" {
+			resources[section] = make(map[string]string)
+			for resource, quantity := range insight[section] {
+				resources[section][resource] = quantity
+			}
+		} else if quantity, ok := insight[section][resource]; ok {
+			if resources[section] == nil {
+				resources[section] = make(map[string]string)
+			}
+			resources[section][resource] = quantity
+		}
+	}
+
+	//a request can never exceed its limit
+	for resource, request := range resources["requests"] {
+		requestVal, err1 := support.ParseQuantity(request)
+		limitVal, err2 := support.ParseQuantity(resources["limits"][resource])
+		if err1 == nil && err2 == nil && requestVal > limitVal {
+			if _, limit := support.InSlice(fields, "limits."+resource); limits || limit {
+				resources["requests"][resource] = resources["limits"][resource]
+			} else {
+				resources["limits"][resource] = request
+			}
+		}
+	}
+
+	return resources
+
+}
+
+func setValuesPath(values map[string]interface{}, path string, resources map[string]map[string]string) {
+
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		if _, ok := values[key].(map[string]interface{}); !ok {
+			values[key] = make(map[string]interface{})
+		}
+		values = values[key].(map[string]interface{})
+	}
+	values[keys[len(keys)-1]] = resources
+
+}
+
+func printValuesOverrides(chartName string) {
+
+	if len(valuesOverrides) == 0 {
+		return
+	}
+
+	valuesYAML, err := yaml.Marshal(valuesOverrides)
+	if err != nil {
+		return
+	}
+
+	fmt.Println("VALUES (" + chartName + "): persist the optimized resources in your values file")
+	for _, line := range strings.Split(strings.TrimSuffix(string(valuesYAML), "\n"), "\n") {
+		fmt.Println("  " + line)
+	}
+	fmt.Println("")
+
+}
+
+func processPodResources(objNamespace string, objType string, objName string, aliasName string, podSpec map[string]interface{}, containers []interface{}) {
+
+	var podResources map[string]map[string]string
+
+	lookupCluster, lookupNamespace, lookupName, mapped := mapLookup(objNamespace, aliasName)
+	specName := objName
+	if mapped {
+		specName = lookupName
+	}
+
+	//try to get recommendation from repo, then k8s, then defaults
+	if insight, approvalSetting, err := getPodInsight(lookupCluster, lookupNamespace, objType, lookupName); err == nil {
+		fmt.Println("pod: [" + approvalSetting + "] " + fmt.Sprint(insight))
+		podResources = insight
+	} else if insight, err := extractPodResourceSpecFromK8S(lookupCluster, lookupNamespace, objType, specName); err == nil {
+		fmt.Println("pod: Checking Cluster: " + fmt.Sprint(insight))
+		podResources = insight
+	} else if val, ok := podSpec["resources"].(map[string]interface{}); ok && len(val) > 0 {
+		podResources = support.ResourceMap(val)
+		fmt.Println("pod: Checking Defaults: " + fmt.Sprint(podResources))
+	} else {
+		return
+	}
+
+	//keep pod-level values consistent with the container-level values
+	for _, adjustment := range reconcilePodResources(podResources, containers) {
+		fmt.Println("  " + adjustment)
+	}
+
+	podSpec["resources"] = podResources
+
+}
+
+func reconcilePodResources(podResources map[string]map[string]string, containers []interface{}) []string {
+
+	var adjustments []string
+
+	for _, resource := range []string{"cpu", "memory"} {
+
+		//sum container requests and find largest container limit
+		var requestSum, limitMax float64
+		for _, container := range containers {
+			containerResources := support.ResourceMap(container.(map[string]interface{})["resources"])
+			if val, err := support.ParseQuantity(containerResources["requests"][resource]); err == nil {
+				requestSum += val
+			}
+			if val, err := support.ParseQuantity(containerResources["limits"][resource]); err == nil && val > limitMax {
+				limitMax = val
+			}
+		}
+
+		//pod request must not be smaller than the sum of container requests
+		if podRequest, ok := podResources["requests"][resource]; ok {
+			if val, err := support.ParseQuantity(podRequest); err != nil || val < requestSum {
+				podResources["requests"][resource] = support.FormatQuantity(resource, requestSum)
+				adjustments = append(adjustments, "pod requests."+resource+" raised to sum of container requests ["+podResources["requests"][resource]+"]")
+			}
+		}
+
+		//pod limit must not be smaller than the pod request or any container limit
+		if podLimit, ok := podResources["limits"][resource]; ok {
+			floor := limitMax
+			if val, err := support.ParseQuantity(podResources["requests"][resource]); err == nil && val > floor {
+				floor = val
+			}
+			if val, err := support.ParseQuantity(podLimit); err != nil || val < floor {
+				podResources["limits"][resource] = support.FormatQuantity(resource, floor)
+				adjustments = append(adjustments, "pod limits."+resource+" raised to ["+podResources["limits"][resource]+"]")
+			}
+		}
+
+	}
+
+	return adjustments
+
+}
+
+func extractPodResourceSpecFromK8S(cluster string, objNamespace string, objType string, objName string) (map[string]map[string]string, error) {
+
+	jsonPath := strings.TrimSuffix(objTypeContainerPath[objType], "containers}") + "resources}"
+
+	stdOut, stdErr, err := support.ExecuteSingleCommand([]string{KubectlBin, "get", objType, objName, "-o=jsonpath=" + jsonPath, "--cluster=" + cluster, "--namespace=" + objNamespace})
+	if err != nil {
+		return nil, errors.New(stdErr)
+	}
+
+	if stdOut == "" || stdOut == "{}" {
+		return nil, errors.New("could not locate pod-level resource spec")
+	}
+
+	var parsedInsight map[string]map[string]string
+	if err := json.Unmarshal([]byte(stdOut), &parsedInsight); err != nil || len(parsedInsight) == 0 {
+		return nil, errors.New("could not locate pod-level resource spec")
+	}
+
+	return parsedInsight, nil
+
+}
+
+func processResizePolicy(container map[string]interface{}, objNamespace string, objType string, objName string, insight map[string]map[string]string) {
+
+	containerName := container["name"].(string)
+
+	if resizePolicyMode == "add" {
+		addResizePolicy(container)
+	}
+
+	current, err := extractResourceSpecFromK8S(remoteCluster, objNamespace, objType, objName, containerName)
+	if err != nil {
+		fmt.Println("  Resize: container not running")
+		return
+	}
+
+	changed, restarts := resizeChanges(container["resizePolicy"], current, insight)
+
+	if len(changed) == 0 {
+		fmt.Println("  Resize: no change")
+	} else if len(restarts) == 0 {
+		fmt.Println("  Resize: in-place [" + strings.Join(changed, ",") + "]")
+	} else {
+		fmt.Println("  Resize: restart [" + strings.Join(restarts, ",") + "]")
+		resizeReport = append(resizeReport, "namespace["+objNamespace+"] objType["+objType+"] objName["+objName+"] container["+containerName+"] restart["+strings.Join(restarts, ",")+"]")
+	}
+
+}
+
+//resizeChanges returns the resources that change between the running and the optimized spec, and those of them that restart the container.
+//A resource without a resizePolicy entry defaults to NotRequired, so only an explicit RestartContainer restarts the container.
+func resizeChanges(resizePolicy interface{}, current map[string]map[string]string, insight map[string]map[string]string) ([]string, []string) {
+
+	restartPolicies := make(map[string]string)
+	if policies, ok := resizePolicy.([]interface{}); ok {
+		for _, policy := range policies {
+			if policyMap, ok := policy.(map[string]interface{}); ok {
+				restartPolicies[support.CheckMap(policyMap, "resourceName")] = support.CheckMap(policyMap, "restartPolicy")
+			}
+		}
+	}
+
+	var changed, restarts []string
+	for _, resource := range []string{"cpu", "memory"} {
+		for _, field := range []string{"requests", "limits"} {
+			currentVal, _ := support.ParseQuantity(current[field][resource])
+			updatedVal, _ := support.ParseQuantity(insight[field][resource])
+			if currentVal != updatedVal {
+				changed = append(changed, resource)
+				if restartPolicies[resource] == "RestartContainer" {
+					restarts = append(restarts, resource)
+				}
+				break
+			}
+		}
+	}
+
+	return changed, restarts
+
+}
+
+func addResizePolicy(container map[string]interface{}) {
+
+	defaults := map[string]string{
+		"cpu":    "NotRequired",
+		"memory": "RestartContainer",
+	}
+
+	policies, _ := container["resizePolicy"].([]interface{})
+	for _, policy := range policies {
+		if policyMap, ok := policy.(map[string]interface{}); ok {
+			delete(defaults, support.CheckMap(policyMap, "resourceName"))
+		}
+	}
+
+	for _, resource := range []string{"cpu", "memory"} {
+		if restartPolicy, ok := defaults[resource]; ok {
+			policies = append(policies, map[string]interface{}{"resourceName": resource, "restartPolicy": restartPolicy})
+		}
+	}
+
+	container["resizePolicy"] = policies
+
+}
+
+func printResizeReport() {
+
+	if resizePolicyMode == "" {
+		return
+	}
+
+	if len(resizeReport) == 0 {
+		fmt.Println("RESIZE: all changes can be applied in-place")
+		fmt.Println("")
+		return
+	}
+
+	fmt.Println("RESIZE: the following changes will restart containers")
+	for _, entry := range resizeReport {
+		fmt.Println("  " + entry)
+	}
+	fmt.Println("")
 
 }
 
@@ -679,7 +2019,7 @@ func interpolateContext() {
 
 	//extract working context-info (cluster and namespace)
 	kubeconfig := os.Getenv("KUBECONFIG")
-	kubecontext := os.Getenv("HELM_KUBECONTEXT")
+	kubeContext = os.Getenv("HELM_KUBECONTEXT")
 	namespace = os.Getenv("HELM_NAMESPACE")
 
 	var stdErr string
@@ -696,19 +2036,30 @@ func interpolateContext() {
 	support.CheckError("", err, true)
 
 	//determine current-context
-	if kubecontext == "" {
-		kubecontext = kubeconfigYAML["current-context"].(string)
+	if kubeContext == "" {
+		kubeContext = kubeconfigYAML["current-context"].(string)
 	}
 
 	//determine local cluster
 	contextList := kubeconfigYAML["contexts"].([]interface{})
 	for _, context := range contextList {
-		if context.(map[string]interface{})["name"] == kubecontext {
+		if context.(map[string]interface{})["name"] == kubeContext {
 			localCluster = context.(map[string]interface{})["context"].(map[string]interface{})["cluster"].(string)
 		}
 	}
 
-	support.LocateConfigNamespace("helm-optimize-plugin")
+	//the secret is only looked for when it holds the configuration
+	if support.ConfigStore != "file" {
+		support.LocateConfigNamespace("helm-optimize-plugin")
+	}
+
+	//select the profile of the current context
+	support.CheckError("", support.SelectProfile(profileName, kubeContext, "helm-optimize-plugin"), true)
+
+}
+
+//resolveRemoteCluster resolves the remote cluster from the config, otherwise from the densify forwarder
+func resolveRemoteCluster() {
 
 	if val, ok := support.RetrieveSecrets("helm-optimize-plugin")["remoteCluster"]; ok {
 		remoteCluster = val
@@ -733,4 +2084,23 @@ func interpolateContext() {
 
 	}
 
+	//mapping rules redirect the lookups of local workloads to other remote workloads
+	rules, err := support.ParseLookupRules(support.RetrieveSecrets("helm-optimize-plugin")["lookupMappings"])
+	if !support.CheckError("invalid lookup mappings -- please reconfigure using 'helm optimize -c --lookup-mapping'", err, false) {
+		lookupRules = rules
+	}
+
+}
+
+//mapLookup applies the first matching lookup rule to the workload, returning the remote cluster, namespace and name to look up
+func mapLookup(objNamespace string, objName string) (string, string, string, bool) {
+
+	for _, rule := range lookupRules {
+		if cluster, ns, name, ok := rule.Map(localCluster, remoteCluster, objNamespace, objName); ok {
+			return cluster, ns, name, true
+		}
+	}
+
+	return remoteCluster, objNamespace, objName, false
+
 }
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/densify-quick-start/helm-optimize-resources/support"
+)
+
+func TestResizeChanges(t *testing.T) {
+
+	current := map[string]map[string]string{
+		"requests": {"cpu": "100m", "memory": "128Mi"},
+		"limits":   {"cpu": "200m", "memory": "256Mi"},
+	}
+	policy := func(cpu string, memory string) interface{} {
+		return []interface{}{
+			map[string]interface{}{"resourceName": "cpu", "restartPolicy": cpu},
+			map[string]interface{}{"resourceName": "memory", "restartPolicy": memory},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		policy   interface{}
+		insight  map[string]map[string]string
+		changed  []string
+		restarts []string
+	}{
+		{"no change", nil, current, nil, nil},
+		{"equivalent quantities", nil, map[string]map[string]string{
+			"requests": {"cpu": "0.1", "memory": "128Mi"},
+			"limits":   {"cpu": "200m", "memory": "256Mi"},
+		}, nil, nil},
+		{"missing policy defaults to NotRequired", nil, map[string]map[string]string{
+			"requests": {"cpu": "150m", "memory": "256Mi"},
+			"limits":   {"cpu": "200m", "memory": "256Mi"},
+		}, []string{"cpu", "memory"}, nil},
+		{"explicit RestartContainer", policy("NotRequired", "RestartContainer"), map[string]map[string]string{
+			"requests": {"cpu": "150m", "memory": "256Mi"},
+			"limits":   {"cpu": "200m", "memory": "256Mi"},
+		}, []string{"cpu", "memory"}, []string{"memory"}},
+		{"limit change only", policy("RestartContainer", "NotRequired"), map[string]map[string]string{
+			"requests": {"cpu": "100m", "memory": "128Mi"},
+			"limits":   {"cpu": "300m", "memory": "256Mi"},
+		}, []string{"cpu"}, []string{"cpu"}},
+	}
+
+	for _, test := range tests {
+		changed, restarts := resizeChanges(test.policy, current, test.insight)
+		if !reflect.DeepEqual(changed, test.changed) || !reflect.DeepEqual(restarts, test.restarts) {
+			t.Errorf("%s: resizeChanges = %v, %v, want %v, %v", test.name, changed, restarts, test.changed, test.restarts)
+		}
+	}
+
+}
+
+func TestDryRun(t *testing.T) {
+
+	tests := []struct {
+		args   []string
+		dryRun bool
+	}{
+		{[]string{"install", "rel", "chart/"}, false},
+		{[]string{"install", "rel", "chart/", "--dry-run"}, true},
+		{[]string{"upgrade", "rel", "chart/", "--dry-run=server"}, true},
+		{[]string{"upgrade", "rel", "chart/", "--dry-run=client"}, true},
+		{[]string{"upgrade", "rel", "chart/", "--dry-run=false"}, false},
+		{[]string{"upgrade", "rel", "chart/", "--dry-run=none"}, false},
+	}
+
+	for _, test := range tests {
+		if dryRun := dryRun(test.args); dryRun != test.dryRun {
+			t.Errorf("dryRun(%v) = %v, want %v", test.args, dryRun, test.dryRun)
+		}
+	}
+
+}
+
+func TestWorkloadAlias(t *testing.T) {
+
+	defer func(originalAliases map[string]string, originalLabels bool, originalAdapter string) {
+		workloadAliases, aliasLabels, adapter = originalAliases, originalLabels, originalAdapter
+	}(workloadAliases, aliasLabels, adapter)
+	workloadAliases = map[string]string{"rel-app": "exact", "*-app": "app", "rel-*": "release", "preview-*-worker": "worker"}
+	aliasLabels = true
+
+	labels := map[string]string{"app.kubernetes.io/name": "shop", "app.kubernetes.io/component": "api"}
+
+	tests := []struct {
+		adapter string
+		objName string
+		labels  map[string]string
+		alias   string
+	}{
+		{"Parameter Store", "rel-app", labels, "exact"},
+		{"Parameter Store", "other-app", labels, "app"},
+		{"Parameter Store", "preview-42-worker", labels, "worker"},
+		{"Parameter Store", "rel-worker", labels, "release"},
+		{"Parameter Store", "frontend", labels, "shop-api"},
+		{"Parameter Store", "frontend", map[string]string{"app.kubernetes.io/name": "shop"}, "shop"},
+		{"Parameter Store", "frontend", map[string]string{}, "frontend"},
+		{"Densify", "other-app", labels, "app"},
+		{"Densify", "frontend", labels, "frontend"},
+	}
+
+	for _, test := range tests {
+		adapter = test.adapter
+		if alias := workloadAlias(test.objName, test.labels); alias != test.alias {
+			t.Errorf("%s: workloadAlias(%s, %v) = %s, want %s", test.adapter, test.objName, test.labels, alias, test.alias)
+		}
+	}
+
+}
+
+func TestOptimizeFields(t *testing.T) {
+
+	tests := []struct {
+		annotations map[string]string
+		fields      []string
+		err         bool
+	}{
+		{map[string]string{}, []string{"requests", "limits"}, false},
+		{map[string]string{"helm-optimize/fields": "requests"}, []string{"requests"}, false},
+		{map[string]string{"helm-optimize/fields": "requests", "helm-optimize/fields.app": "limits.cpu, requests.memory"}, []string{"limits.cpu", "requests.memory"}, false},
+		{map[string]string{"helm-optimize/fields": "limit.cpu"}, nil, true},
+		{map[string]string{"helm-optimize/fields.app": "requests,limits.disk"}, nil, true},
+	}
+
+	for _, test := range tests {
+		fields, err := optimizeFields(test.annotations, "app")
+		if (err != nil) != test.err || !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("optimizeFields(%v) = %v (%v), want %v, error %v", test.annotations, fields, err, test.fields, test.err)
+		}
+	}
+
+}
+
+func TestMergeResources(t *testing.T) {
+
+	existing := map[string]interface{}{
+		"requests": map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+		"limits":   map[string]interface{}{"cpu": "200m", "memory": "256Mi"},
+	}
+	insight := map[string]map[string]string{
+		"requests": {"cpu": "300m", "memory": "64Mi"},
+		"limits":   {"cpu": "400m", "memory": "128Mi"},
+	}
+
+	tests := []struct {
+		fields    []string
+		resources map[string]map[string]string
+	}{
+		{[]string{"requests", "limits"}, insight},
+		{[]string{"limits"}, map[string]map[string]string{
+			"requests": {"cpu": "100m", "memory": "128Mi"},
+			"limits":   {"cpu": "400m", "memory": "128Mi"},
+		}},
+		//a recommended request above the chart limit raises the limit
+		{[]string{"requests"}, map[string]map[string]string{
+			"requests": {"cpu": "300m", "memory": "64Mi"},
+			"limits":   {"cpu": "300m", "memory": "256Mi"},
+		}},
+		{[]string{"requests.memory", "limits.cpu"}, map[string]map[string]string{
+			"requests": {"cpu": "100m", "memory": "64Mi"},
+			"limits":   {"cpu": "400m", "memory": "256Mi"},
+		}},
+		//a recommended limit below the chart request lowers the request
+		{[]string{"limits.memory"}, map[string]map[string]string{
+			"requests": {"cpu": "100m", "memory": "128Mi"},
+			"limits":   {"cpu": "200m", "memory": "128Mi"},
+		}},
+	}
+
+	for _, test := range tests {
+		if resources := mergeResources(existing, insight, test.fields); !reflect.DeepEqual(resources, test.resources) {
+			t.Errorf("mergeResources(%v) = %v, want %v", test.fields, resources, test.resources)
+		}
+	}
+
+}
+
+//TestProcessChartPolicy checks an invalid policy in a subchart fails the whole chart
+func TestProcessChartPolicy(t *testing.T) {
+
+	chartDir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(chartDir)
+
+	subchartDir := chartDir + "/charts/sub"
+	os.MkdirAll(subchartDir, 0755)
+	ioutil.WriteFile(chartDir+"/Chart.yaml", []byte("name: parent\n"), 0644)
+	ioutil.WriteFile(subchartDir+"/Chart.yaml", []byte("name: sub\n"), 0644)
+
+	if err := processChart(chartDir, []string{"install"}); err != nil {
+		t.Errorf("processChart without a policy = %v, want no error", err)
+	}
+
+	ioutil.WriteFile(subchartDir+"/optimize.yaml", []byte("limitStrategy: sometimes\n"), 0644)
+	if err := processChart(chartDir, []string{"install"}); err == nil || !strings.HasPrefix(err.Error(), "chart [sub]: ") {
+		t.Errorf("processChart with an invalid subchart policy = %v, want a chart [sub] error", err)
+	}
+
+}
+
+func TestExtractPluginFlags(t *testing.T) {
+
+	defer func(originalSelector string, originalProfile string) {
+		labelSelector, profileName = originalSelector, originalProfile
+	}(labelSelector, profileName)
+
+	tests := []struct {
+		args     []string
+		helmArgs []string
+		selector string
+		profile  string
+	}{
+		{[]string{"upgrade", "rel", "chart/", "--selector", "tier=web", "--profile", "prod"}, []string{"upgrade", "rel", "chart/"}, "tier=web", "prod"},
+		{[]string{"--profile=prod", "template", "rel", "chart/", "--selector=tier=web"}, []string{"template", "rel", "chart/"}, "tier=web", "prod"},
+		{[]string{"list", "--selector", "owner=helm", "--profile", "prod"}, []string{"list", "--selector", "owner=helm"}, "", "prod"},
+		{[]string{"-c", "--profile", "prod"}, []string{"-c"}, "", "prod"},
+	}
+
+	for _, test := range tests {
+		labelSelector, profileName = "", ""
+		helmArgs, err := extractPluginFlags(test.args)
+		if err != nil || !reflect.DeepEqual(helmArgs, test.helmArgs) || labelSelector != test.selector || profileName != test.profile {
+			t.Errorf("extractPluginFlags(%v) = %v (%v) selector [%s] profile [%s], want %v selector [%s] profile [%s]", test.args, helmArgs, err, labelSelector, profileName, test.helmArgs, test.selector, test.profile)
+		}
+	}
+
+}
+
+func TestDeviations(t *testing.T) {
+
+	recommended := map[string]map[string]string{
+		"requests": {"cpu": "300m", "memory": "256Mi"},
+		"limits":   {"cpu": "500m", "memory": "512Mi"},
+	}
+
+	tests := []struct {
+		deployed   map[string]map[string]string
+		deviations []string
+	}{
+		{map[string]map[string]string{
+			"requests": {"cpu": "0.3", "memory": "256Mi"},
+			"limits":   {"cpu": "500m", "memory": "512Mi"},
+		}, nil},
+		//raised to a policy minimum, and limits removed by the policy
+		{map[string]map[string]string{
+			"requests": {"cpu": "300m", "memory": "1Gi"},
+		}, []string{"requests.memory=1Gi (recommended 256Mi)", "limits.cpu=none (recommended 500m)", "limits.memory=none (recommended 512Mi)"}},
+	}
+
+	for _, test := range tests {
+		if changes := deviations(recommended, test.deployed); !reflect.DeepEqual(changes, test.deviations) {
+			t.Errorf("deviations(%v) = %v, want %v", test.deployed, changes, test.deviations)
+		}
+	}
+
+}
+
+//TestProcessProfileSwitches runs the profile switches against a local config file in a child process, as they exit once done
+func TestProcessProfileSwitches(t *testing.T) {
+
+	if args := os.Getenv("HELM_OPTIMIZE_TEST_ARGS"); args != "" {
+		kubeContext, profileName = "dev-kind", os.Getenv("HELM_OPTIMIZE_TEST_PROFILE")
+		support.CheckError("", support.InitConfig("", "file"), true)
+		support.CheckError("", support.SelectProfile(profileName, kubeContext, "helm-optimize-plugin"), true)
+		processProfileSwitches(strings.Fields(args))
+		os.Exit(0)
+	}
+
+	dir, err := ioutil.TempDir("", "helm-optimize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yaml")
+
+	tests := []struct {
+		args    string
+		profile string
+		output  string
+		failed  bool
+		config  string
+	}{
+		{"-p --switch prod", "", "context [dev-kind] now uses profile [prod]", false, "profileContexts: '{\"dev-kind\":\"prod\"}'"},
+		{"-p --switch staging", "", "profile [staging] does not exist", false, ""},
+		{"-p --delete prod", "", "profile [prod] deleted", false, "adapter: Densify\n"},
+		{"-p --list", "", "* default\n  prod", false, ""},
+		{"list", "staging", "profile [staging] does not exist", true, ""},
+		{"list", "prod", "", false, ""},
+	}
+
+	for _, test := range tests {
+
+		if err := ioutil.WriteFile(configFile, []byte("adapter: Densify\nprofile.prod.adapter: Parameter Store\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestProcessProfileSwitches$")
+		cmd.Env = append(os.Environ(), "HELM_OPTIMIZE_CONFIG="+configFile, "HELM_OPTIMIZE_PROFILE=", "HELM_OPTIMIZE_TEST_ARGS="+test.args, "HELM_OPTIMIZE_TEST_PROFILE="+test.profile)
+		output, err := cmd.CombinedOutput()
+		if (err != nil) != test.failed || !strings.Contains(string(output), test.output) {
+			t.Errorf("%s with profile [%s] = %s (%v), want %s", test.args, test.profile, output, err, test.output)
+		}
+
+		config, _ := ioutil.ReadFile(configFile)
+		if !strings.Contains(string(config), test.config) || (test.config == "adapter: Densify\n" && string(config) != test.config) {
+			t.Errorf("%s: config = %s, want %s", test.args, config, test.config)
+		}
+
+	}
+
+}
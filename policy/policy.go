@@ -0,0 +1,292 @@
+package policy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/densify-quick-start/helm-optimize-resources/support"
+	"github.com/ghodss/yaml"
+)
+
+//FileName is the name of the policy file shipped next to Chart.yaml
+const FileName = "optimize.yaml"
+
+//Range holds the lower and upper bound of a single resource quantity
+type Range struct {
+	Min string `json:"min,omitempty"`
+	Max string `json:"max,omitempty"`
+}
+
+//Confidence holds the minimum audit requirements a recommendation must meet before it is applied
+type Confidence struct {
+	MinDataDays              int `json:"minDataDays,omitempty"`
+	MinSeenCount             int `json:"minSeenCount,omitempty"`
+	MaxRecommendationAgeDays int `json:"maxRecommendationAgeDays,omitempty"`
+}
+
+//Policy holds the optimization policy of a chart or user
+type Policy struct {
+	ExcludeContainers []string                               `json:"excludeContainers,omitempty"`
+	LimitStrategy     string                                 `json:"limitStrategy,omitempty"`
+	LimitRatio        float64                                `json:"limitRatio,omitempty"`
+	Bounds            map[string]map[string]map[string]Range `json:"bounds,omitempty"`
+	ValuesPaths       map[string]string                      `json:"valuesPaths,omitempty"`
+	Confidence        Confidence                             `json:"confidence,omitempty"`
+}
+
+var limitStrategies = []string{"", "recommended", "keep", "none", "ratio"}
+
+////////////////////////////////////////////////////////
+////////////////EXTERNAL FUNCTIONS//////////////////////
+////////////////////////////////////////////////////////
+
+//Load reads a policy file.  A missing file results in an empty policy.
+func Load(path string) (*Policy, error) {
+
+	policy := &Policy{}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return policy, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(content, policy); err != nil {
+		return nil, errors.New("'" + path + "' not a valid policy file")
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, errors.New("'" + path + "' " + err.Error())
+	}
+
+	return policy, nil
+
+}
+
+//Merge returns a new policy where the values of override take precedence over the values of p.
+func (p *Policy) Merge(override *Policy) *Policy {
+
+	merged := &Policy{
+		Bounds:      make(map[string]map[string]map[string]Range),
+		ValuesPaths: make(map[string]string),
+	}
+
+	for _, policy := range []*Policy{p, override} {
+
+		if policy == nil {
+			continue
+		}
+
+		for _, container := range policy.ExcludeContainers {
+			if _, found := support.InSlice(merged.ExcludeContainers, container); !found {
+				merged.ExcludeContainers = append(merged.ExcludeContainers, container)
+			}
+		}
+
+		if policy.LimitStrategy != "" {
+			merged.LimitStrategy = policy.LimitStrategy
+		}
+		if policy.LimitRatio != 0 {
+			merged.LimitRatio = policy.LimitRatio
+		}
+
+		for container, fields := range policy.Bounds {
+			if _, ok := merged.Bounds[container]; !ok {
+				merged.Bounds[container] = make(map[string]map[string]Range)
+			}
+			for field, resources := range fields {
+				if _, ok := merged.Bounds[container][field]; !ok {
+					merged.Bounds[container][field] = make(map[string]Range)
+				}
+				for resource, bounds := range resources {
+					merged.Bounds[container][field][resource] = bounds
+				}
+			}
+		}
+
+		for container, path := range policy.ValuesPaths {
+			merged.ValuesPaths[container] = path
+		}
+
+		if policy.Confidence.MinDataDays != 0 {
+			merged.Confidence.MinDataDays = policy.Confidence.MinDataDays
+		}
+		if policy.Confidence.MinSeenCount != 0 {
+			merged.Confidence.MinSeenCount = policy.Confidence.MinSeenCount
+		}
+		if policy.Confidence.MaxRecommendationAgeDays != 0 {
+			merged.Confidence.MaxRecommendationAgeDays = policy.Confidence.MaxRecommendationAgeDays
+		}
+
+	}
+
+	return merged
+
+}
+
+//Excluded checks whether the container is excluded from optimization.
+func (p *Policy) Excluded(containerName string) bool {
+	_, found := support.InSlice(p.ExcludeContainers, containerName)
+	return found
+}
+
+//Apply enforces the limit strategy and bounds on the resources recommended for a container.
+//The existing resources are those defined in the chart, and are used by the 'keep' limit strategy.
+func (p *Policy) Apply(containerName string, existing map[string]map[string]string, resources map[string]map[string]string) (map[string]map[string]string, []string) {
+
+	var notes []string
+
+	applied := make(map[string]map[string]string)
+	for field, quantities := range resources {
+		applied[field] = make(map[string]string)
+		for resource, quantity := range quantities {
+			applied[field][resource] = quantity
+		}
+	}
+
+	//enforce limit strategy
+	switch p.LimitStrategy {
+	case "keep":
+		if limits, ok := existing["limits"]; ok && len(limits) > 0 {
+			applied["limits"] = make(map[string]string)
+			for resource, quantity := range limits {
+				applied["limits"][resource] = quantity
+			}
+		} else {
+			delete(applied, "limits")
+		}
+		notes = append(notes, "limits kept from chart")
+	case "none":
+		delete(applied, "limits")
+		notes = append(notes, "limits removed")
+	case "ratio":
+		applied["limits"] = make(map[string]string)
+		for resource, request := range applied["requests"] {
+			if value, err := support.ParseQuantity(request); err == nil {
+				applied["limits"][resource] = support.FormatQuantity(resource, value*p.LimitRatio)
+			}
+		}
+		notes = append(notes, "limits set to "+strconv.FormatFloat(p.LimitRatio, 'f', -1, 64)+"x requests")
+	}
+
+	//enforce bounds, container specific bounds override the '*' bounds of the same field and resource
+	for _, field := range []string{"requests", "limits"} {
+		fieldBounds := make(map[string]Range)
+		for _, key := range []string{"*", containerName} {
+			for resource, bounds := range p.Bounds[key][field] {
+				fieldBounds[resource] = bounds
+			}
+		}
+		var resources []string
+		for resource := range fieldBounds {
+			resources = append(resources, resource)
+		}
+		sort.Strings(resources)
+		for _, resource := range resources {
+			bounds := fieldBounds[resource]
+			quantity, ok := applied[field][resource]
+			if !ok {
+				continue
+			}
+			value, err := support.ParseQuantity(quantity)
+			if err != nil {
+				continue
+			}
+			if min, err := support.ParseQuantity(bounds.Min); err == nil && value < min {
+				applied[field][resource] = bounds.Min
+				notes = append(notes, field+"."+resource+" raised to policy minimum ["+bounds.Min+"]")
+			} else if max, err := support.ParseQuantity(bounds.Max); err == nil && value > max {
+				applied[field][resource] = bounds.Max
+				notes = append(notes, field+"."+resource+" lowered to policy maximum ["+bounds.Max+"]")
+			}
+		}
+	}
+
+	//a request can never exceed its limit
+	for resource, request := range applied["requests"] {
+		requestVal, err1 := support.ParseQuantity(request)
+		limitVal, err2 := support.ParseQuantity(applied["limits"][resource])
+		if err1 == nil && err2 == nil && requestVal > limitVal {
+			applied["limits"][resource] = request
+			notes = append(notes, "limits."+resource+" raised to match request ["+request+"]")
+		}
+	}
+
+	return applied, notes
+
+}
+
+//Gate checks the audit metadata of a recommendation against the confidence policy, and returns the reason it should be skipped (if any).
+func (p *Policy) Gate(meta support.InsightMeta) string {
+
+	if p.Confidence.MinDataDays > 0 && meta.DataDays < p.Confidence.MinDataDays {
+		return "only " + strconv.Itoa(meta.DataDays) + " days of data, policy requires " + strconv.Itoa(p.Confidence.MinDataDays)
+	}
+
+	if p.Confidence.MinSeenCount > 0 && meta.SeenCount < p.Confidence.MinSeenCount {
+		return "recommendation seen " + strconv.Itoa(meta.SeenCount) + " times, policy requires " + strconv.Itoa(p.Confidence.MinSeenCount)
+	}
+
+	if p.Confidence.MaxRecommendationAgeDays > 0 {
+		age := int(time.Since(meta.LastSeen).Hours() / 24)
+		if age > p.Confidence.MaxRecommendationAgeDays {
+			return "recommendation last seen " + strconv.Itoa(age) + " days ago, policy allows " + strconv.Itoa(p.Confidence.MaxRecommendationAgeDays)
+		}
+	}
+
+	return ""
+
+}
+
+//Gated checks whether the policy places any confidence requirements on recommendations.
+func (p *Policy) Gated() bool {
+	return p.Confidence != Confidence{}
+}
+
+//ValuesPath returns the values path mapped to the container, if any.
+func (p *Policy) ValuesPath(containerName string) (string, bool) {
+	path, ok := p.ValuesPaths[containerName]
+	return path, ok
+}
+
+////////////////////////////////////////////////////////
+///////////////////LOCAL FUNCTIONS//////////////////////
+////////////////////////////////////////////////////////
+
+func (p *Policy) validate() error {
+
+	if _, found := support.InSlice(limitStrategies, p.LimitStrategy); !found {
+		return errors.New("contains invalid limitStrategy [" + p.LimitStrategy + "]")
+	}
+
+	if p.Confidence.MinDataDays < 0 || p.Confidence.MinSeenCount < 0 || p.Confidence.MaxRecommendationAgeDays < 0 {
+		return errors.New("contains negative confidence requirements")
+	}
+
+	if p.LimitStrategy == "ratio" && p.LimitRatio < 1 {
+		return errors.New("requires limitRatio >= 1 for limitStrategy [ratio]")
+	}
+
+	for container, fields := range p.Bounds {
+		for field, resources := range fields {
+			if field != "requests" && field != "limits" {
+				return errors.New("contains invalid bounds field [" + container + "." + field + "]")
+			}
+			for resource, bounds := range resources {
+				for _, quantity := range []string{bounds.Min, bounds.Max} {
+					if _, err := support.ParseQuantity(quantity); quantity != "" && err != nil {
+						return errors.New("contains invalid bound [" + container + "." + field + "." + resource + "]")
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/densify-quick-start/helm-optimize-resources/support"
+)
+
+func TestApply(t *testing.T) {
+
+	recommended := map[string]map[string]string{
+		"requests": {"cpu": "3000m", "memory": "256Mi"},
+		"limits":   {"cpu": "3000m", "memory": "512Mi"},
+	}
+	existing := map[string]map[string]string{
+		"limits": {"cpu": "4000m", "memory": "1Gi"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		applied map[string]map[string]string
+		notes   []string
+	}{
+		{"no policy", Policy{}, recommended, nil},
+		{"'*' bound", Policy{Bounds: map[string]map[string]map[string]Range{
+			"*": {"requests": {"cpu": {Max: "1"}}, "limits": {"cpu": {Max: "1"}}},
+		}}, map[string]map[string]string{
+			"requests": {"cpu": "1", "memory": "256Mi"},
+			"limits":   {"cpu": "1", "memory": "512Mi"},
+		}, []string{"requests.cpu lowered to policy maximum [1]", "limits.cpu lowered to policy maximum [1]"}},
+		{"container bound loosens '*' bound", Policy{Bounds: map[string]map[string]map[string]Range{
+			"*":   {"requests": {"cpu": {Max: "1"}, "memory": {Min: "512Mi"}}},
+			"app": {"requests": {"cpu": {Max: "4"}}},
+		}}, map[string]map[string]string{
+			"requests": {"cpu": "3000m", "memory": "512Mi"},
+			"limits":   {"cpu": "3000m", "memory": "512Mi"},
+		}, []string{"requests.memory raised to policy minimum [512Mi]"}},
+		{"other container keeps '*' bound", Policy{Bounds: map[string]map[string]map[string]Range{
+			"*":      {"requests": {"cpu": {Max: "1"}}},
+			"worker": {"requests": {"cpu": {Max: "4"}}},
+		}}, map[string]map[string]string{
+			"requests": {"cpu": "1", "memory": "256Mi"},
+			"limits":   {"cpu": "3000m", "memory": "512Mi"},
+		}, []string{"requests.cpu lowered to policy maximum [1]"}},
+		{"keep limits", Policy{LimitStrategy: "keep"}, map[string]map[string]string{
+			"requests": {"cpu": "3000m", "memory": "256Mi"},
+			"limits":   {"cpu": "4000m", "memory": "1Gi"},
+		}, []string{"limits kept from chart"}},
+		{"no limits", Policy{LimitStrategy: "none"}, map[string]map[string]string{
+			"requests": {"cpu": "3000m", "memory": "256Mi"},
+		}, []string{"limits removed"}},
+		{"ratio limits", Policy{LimitStrategy: "ratio", LimitRatio: 2}, map[string]map[string]string{
+			"requests": {"cpu": "3000m", "memory": "256Mi"},
+			"limits":   {"cpu": "6000m", "memory": "512Mi"},
+		}, []string{"limits set to 2x requests"}},
+		{"request raised above limit", Policy{Bounds: map[string]map[string]map[string]Range{
+			"*": {"requests": {"memory": {Min: "1Gi"}}},
+		}}, map[string]map[string]string{
+			"requests": {"cpu": "3000m", "memory": "1Gi"},
+			"limits":   {"cpu": "3000m", "memory": "1Gi"},
+		}, []string{"requests.memory raised to policy minimum [1Gi]", "limits.memory raised to match request [1Gi]"}},
+	}
+
+	for _, test := range tests {
+		applied, notes := test.policy.Apply("app", existing, recommended)
+		if !reflect.DeepEqual(applied, test.applied) {
+			t.Errorf("%s: Apply = %v, want %v", test.name, applied, test.applied)
+		}
+		if !reflect.DeepEqual(notes, test.notes) {
+			t.Errorf("%s: notes = %q, want %q", test.name, notes, test.notes)
+		}
+	}
+
+}
+
+func TestGate(t *testing.T) {
+
+	policy := &Policy{Confidence: Confidence{MinDataDays: 7, MinSeenCount: 3, MaxRecommendationAgeDays: 14}}
+
+	tests := []struct {
+		name    string
+		meta    support.InsightMeta
+		skipped bool
+	}{
+		{"confident", support.InsightMeta{DataDays: 30, SeenCount: 5, LastSeen: time.Now()}, false},
+		{"too few days", support.InsightMeta{DataDays: 2, SeenCount: 5, LastSeen: time.Now()}, true},
+		{"seen too rarely", support.InsightMeta{DataDays: 30, SeenCount: 1, LastSeen: time.Now()}, true},
+		{"too old", support.InsightMeta{DataDays: 30, SeenCount: 5, LastSeen: time.Now().AddDate(0, 0, -30)}, true},
+	}
+
+	for _, test := range tests {
+		if reason := policy.Gate(test.meta); (reason != "") != test.skipped {
+			t.Errorf("%s: Gate = %q, want skipped %v", test.name, reason, test.skipped)
+		}
+	}
+
+	if reason := (&Policy{}).Gate(support.InsightMeta{}); reason != "" || (&Policy{}).Gated() {
+		t.Errorf("empty policy should not gate recommendations, got %q", reason)
+	}
+
+}
+
+func TestMerge(t *testing.T) {
+
+	chart := &Policy{
+		ExcludeContainers: []string{"envoy"},
+		LimitStrategy:     "keep",
+		Bounds:            map[string]map[string]map[string]Range{"*": {"requests": {"cpu": {Min: "100m"}}}},
+		Confidence:        Confidence{MinDataDays: 7},
+	}
+	user := &Policy{
+		ExcludeContainers: []string{"istio-proxy", "envoy"},
+		LimitStrategy:     "ratio",
+		LimitRatio:        1.5,
+		Bounds:            map[string]map[string]map[string]Range{"*": {"requests": {"memory": {Max: "1Gi"}}}},
+	}
+
+	merged := chart.Merge(user)
+	if !reflect.DeepEqual(merged.ExcludeContainers, []string{"envoy", "istio-proxy"}) {
+		t.Errorf("ExcludeContainers = %v", merged.ExcludeContainers)
+	}
+	if merged.LimitStrategy != "ratio" || merged.LimitRatio != 1.5 {
+		t.Errorf("LimitStrategy = %s x%v, want ratio x1.5", merged.LimitStrategy, merged.LimitRatio)
+	}
+	if len(merged.Bounds["*"]["requests"]) != 2 || merged.Confidence.MinDataDays != 7 {
+		t.Errorf("Bounds = %v, Confidence = %v", merged.Bounds, merged.Confidence)
+	}
+
+}
@@ -0,0 +1,235 @@
+package ssm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//apiError holds the error returned by the aws json protocol
+type apiError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+////////////////////////////////////////////////////////
+///////////////////LOCAL FUNCTIONS//////////////////////
+////////////////////////////////////////////////////////
+
+//serviceEndpoint resolves the endpoint of an aws service.  A configured endpoint (eg. a local ssm compatible stand-in) takes precedence
+//for parameter store only, sts calls (credential validation and role assumption) always go to sts.
+func serviceEndpoint(service string) string {
+
+	if endpoint != "" && service == "ssm" {
+		return strings.TrimSuffix(endpoint, "/") + "/"
+	}
+
+	if val := os.Getenv("AWS_ENDPOINT_URL_" + strings.ToUpper(service)); val != "" {
+		return strings.TrimSuffix(val, "/") + "/"
+	}
+
+	if val := os.Getenv("AWS_ENDPOINT_URL"); val != "" {
+		return strings.TrimSuffix(val, "/") + "/"
+	}
+
+	domain := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		domain = "amazonaws.com.cn"
+	}
+
+	return "https://" + service + "." + region + "." + domain + "/"
+
+}
+
+//callSSM invokes a parameter store api operation using the aws json 1.1 protocol
+func callSSM(operation string, input interface{}, output interface{}) error {
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", serviceEndpoint("ssm"), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonSSM."+operation)
+
+	creds, err := getCredentials()
+	if err != nil {
+		return err
+	}
+
+	respBody, err := sendSigned(req, body, "ssm", creds)
+	if err != nil {
+		var respErr apiError
+		if json.Unmarshal([]byte(err.Error()), &respErr) == nil && respErr.Type != "" {
+			return errors.New(respErr.Type[strings.LastIndex(respErr.Type, "#")+1:] + ": " + respErr.Message)
+		}
+		return err
+	}
+
+	if output != nil {
+		return json.Unmarshal(respBody, output)
+	}
+
+	return nil
+
+}
+
+//callSTS invokes a signed sts api action using the aws query protocol
+func callSTS(action string, params map[string]string, output interface{}) error {
+
+	creds, err := getCredentials()
+	if err != nil {
+		return err
+	}
+
+	return callSTSWithCredentials(creds, action, params, output)
+
+}
+
+func callSTSWithCredentials(creds awsCredentials, action string, params map[string]string, output interface{}) error {
+
+	form := url.Values{}
+	form.Set("Action", action)
+	form.Set("Version", "2011-06-15")
+	for key, val := range params {
+		form.Set(key, val)
+	}
+	body := []byte(form.Encode())
+
+	req, err := http.NewRequest("POST", serviceEndpoint("sts"), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	respBody, err := sendSigned(req, body, "sts", creds)
+	if err != nil {
+		return err
+	}
+
+	return xml.Unmarshal(respBody, output)
+
+}
+
+func sendSigned(req *http.Request, body []byte, service string, creds awsCredentials) ([]byte, error) {
+
+	signRequest(req, body, creds, service, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New(string(respBody))
+	}
+
+	return respBody, nil
+
+}
+
+//signRequest signs the request using aws signature version 4
+func signRequest(req *http.Request, body []byte, creds awsCredentials, service string, now time.Time) {
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	//canonical headers are lowercase, trimmed and sorted
+	var headerNames []string
+	headers := make(map[string]string)
+	for name, values := range req.Header {
+		lowerName := strings.ToLower(name)
+		headerNames = append(headerNames, lowerName)
+		headers[lowerName] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//callerArn caches the arn of the caller once resolved
+var callerArn string
+
+//getCallerIdentity validates the credentials and returns the arn of the caller
+func getCallerIdentity() (string, error) {
+
+	if callerArn != "" {
+		return callerArn, nil
+	}
+
+	var result struct {
+		Arn string `xml:"GetCallerIdentityResult>Arn"`
+	}
+	if err := callSTS("GetCallerIdentity", nil, &result); err != nil {
+		return "", err
+	}
+	callerArn = result.Arn
+
+	return callerArn, nil
+
+}
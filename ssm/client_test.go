@@ -0,0 +1,85 @@
+package ssm
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestSignRequest checks the signature against the vectors of the aws signature version 4 test suite
+func TestSignRequest(t *testing.T) {
+
+	defer func(original string) { region = original }(region)
+	region = "us-east-1"
+
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		contentType   string
+		body          string
+		authorization string
+	}{
+		{"get-vanilla", "GET", "https://example.amazonaws.com/", "", "",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "https://example.amazonaws.com/?Param2=value2&Param1=value1", "", "",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"post-vanilla", "POST", "https://example.amazonaws.com/", "", "",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"post-x-www-form-urlencoded", "POST", "https://example.amazonaws.com/", "application/x-www-form-urlencoded", "Param1=value1",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		signRequest(req, []byte(test.body), creds, "service", now)
+		if authorization := req.Header.Get("Authorization"); authorization != test.authorization {
+			t.Errorf("%s: Authorization = %s, want %s", test.name, authorization, test.authorization)
+		}
+	}
+
+}
+
+func TestServiceEndpoint(t *testing.T) {
+
+	defer func(originalEndpoint string, originalRegion string) {
+		endpoint, region = originalEndpoint, originalRegion
+	}(endpoint, region)
+	for _, name := range []string{"AWS_ENDPOINT_URL", "AWS_ENDPOINT_URL_SSM", "AWS_ENDPOINT_URL_STS"} {
+		if val, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			defer os.Setenv(name, val)
+		}
+	}
+
+	tests := []struct {
+		endpoint string
+		region   string
+		service  string
+		url      string
+	}{
+		{"", "us-east-1", "ssm", "https://ssm.us-east-1.amazonaws.com/"},
+		{"", "cn-north-1", "sts", "https://sts.cn-north-1.amazonaws.com.cn/"},
+		{"http://localhost:4566/", "us-east-1", "ssm", "http://localhost:4566/"},
+		{"http://localhost:4566", "us-east-1", "sts", "https://sts.us-east-1.amazonaws.com/"},
+	}
+
+	for _, test := range tests {
+		endpoint, region = test.endpoint, test.region
+		if url := serviceEndpoint(test.service); url != test.url {
+			t.Errorf("serviceEndpoint(%s) with endpoint [%s] = %s, want %s", test.service, test.endpoint, url, test.url)
+		}
+	}
+
+}
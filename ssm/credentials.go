@@ -0,0 +1,255 @@
+package ssm
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//awsCredentials holds the credentials used to sign requests
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+//credentialCache holds the credentials resolved for the configured profile and role
+var credentialCache *awsCredentials
+
+//defaultSessionName is the session name used to assume a role when none is configured
+const defaultSessionName = "helm-optimize"
+
+////////////////////////////////////////////////////////
+///////////////////LOCAL FUNCTIONS//////////////////////
+////////////////////////////////////////////////////////
+
+//getCredentials resolves credentials from the environment, web identity or the shared config/credential files (in that order), then assumes the configured role (if any).
+func getCredentials() (awsCredentials, error) {
+
+	if credentialCache != nil && (credentialCache.Expires.IsZero() || time.Now().Add(time.Minute).Before(credentialCache.Expires)) {
+		return *credentialCache, nil
+	}
+
+	creds, err := resolveCredentials(profile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	//the profile credentials are only used to assume the configured role
+	if roleArn != "" {
+		if creds, err = assumeRole(creds, roleArn, externalID, roleSessionName); err != nil {
+			return awsCredentials{}, err
+		}
+	}
+
+	credentialCache = &creds
+	return creds, nil
+
+}
+
+func resolveCredentials(profileName string) (awsCredentials, error) {
+
+	//environment variables are only used for the default profile
+	if profileName == "" || profileName == "default" {
+		if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
+			return awsCredentials{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}, nil
+		}
+		if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "" {
+			return assumeRoleWithWebIdentity(os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_ROLE_SESSION_NAME"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+		}
+	}
+
+	if profileName == "" {
+		profileName = "default"
+	}
+
+	//shared credentials file takes precedence over the shared config file
+	credsFile := loadSharedFile(sharedFilePath("AWS_SHARED_CREDENTIALS_FILE", "credentials"), false)
+	if section, ok := credsFile[profileName]; ok && section["aws_access_key_id"] != "" {
+		return awsCredentials{
+			AccessKeyID:     section["aws_access_key_id"],
+			SecretAccessKey: section["aws_secret_access_key"],
+			SessionToken:    section["aws_session_token"],
+		}, nil
+	}
+
+	configFile := loadSharedFile(sharedFilePath("AWS_CONFIG_FILE", "config"), true)
+	if section, ok := configFile[profileName]; ok {
+		if section["aws_access_key_id"] != "" {
+			return awsCredentials{
+				AccessKeyID:     section["aws_access_key_id"],
+				SecretAccessKey: section["aws_secret_access_key"],
+				SessionToken:    section["aws_session_token"],
+			}, nil
+		}
+		if section["web_identity_token_file"] != "" && section["role_arn"] != "" {
+			return assumeRoleWithWebIdentity(section["role_arn"], section["role_session_name"], section["web_identity_token_file"])
+		}
+	}
+
+	return awsCredentials{}, errors.New("unable to resolve AWS credentials for profile [" + profileName + "]")
+
+}
+
+//profileRegion returns the region configured for the profile in the shared config file
+func profileRegion(profileName string) string {
+
+	if profileName == "" {
+		profileName = "default"
+	}
+
+	return loadSharedFile(sharedFilePath("AWS_CONFIG_FILE", "config"), true)[profileName]["region"]
+
+}
+
+func sharedFilePath(envVar string, fileName string) string {
+
+	if path := os.Getenv(envVar); path != "" {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".aws", fileName)
+
+}
+
+//loadSharedFile parses an aws ini file into its sections.  In the config file, sections other than default are prefixed with 'profile '.
+func loadSharedFile(path string, config bool) map[string]map[string]string {
+
+	sections := make(map[string]map[string]string)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return sections
+	}
+	defer file.Close()
+
+	var section string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if config {
+				section = strings.TrimSpace(strings.TrimPrefix(section, "profile "))
+			}
+			if _, ok := sections[section]; !ok {
+				sections[section] = make(map[string]string)
+			}
+			continue
+		}
+		if pair := strings.SplitN(line, "=", 2); len(pair) == 2 && section != "" {
+			sections[section][strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+	}
+
+	return sections
+
+}
+
+func assumeRoleWithWebIdentity(roleArn string, sessionName string, tokenFile string) (awsCredentials, error) {
+
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, errors.New("unable to read web identity token file [" + tokenFile + "]")
+	}
+
+	if sessionName == "" {
+		sessionName = "helm-optimize-" + strconv.FormatInt(time.Now().Unix(), 10)
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", roleArn)
+	form.Set("RoleSessionName", sessionName)
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	//AssumeRoleWithWebIdentity is not signed
+	resp, err := http.PostForm(serviceEndpoint("sts"), form)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != 200 {
+		return awsCredentials{}, errors.New("unable to assume role with web identity: " + string(body))
+	}
+
+	var result struct {
+		Credentials stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return awsCredentials{}, errors.New("unable to parse web identity credentials")
+	}
+
+	return result.Credentials.toCredentials(), nil
+
+}
+
+func assumeRole(creds awsCredentials, roleArn string, externalID string, sessionName string) (awsCredentials, error) {
+
+	if sessionName == "" {
+		sessionName = defaultSessionName
+	}
+
+	params := map[string]string{"RoleArn": roleArn, "RoleSessionName": sessionName}
+	if externalID != "" {
+		params["ExternalId"] = externalID
+	}
+
+	var result struct {
+		Credentials stsCredentials `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := callSTSWithCredentials(creds, "AssumeRole", params, &result); err != nil {
+		return awsCredentials{}, errors.New("unable to assume role [" + roleArn + "]: " + err.Error())
+	}
+
+	return result.Credentials.toCredentials(), nil
+
+}
+
+//stsCredentials holds the credentials returned by the sts assume role apis
+type stsCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	SessionToken    string `xml:"SessionToken"`
+	Expiration      string `xml:"Expiration"`
+}
+
+func (c stsCredentials) toCredentials() awsCredentials {
+
+	expires, _ := time.Parse(time.RFC3339, c.Expiration)
+
+	return awsCredentials{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		Expires:         expires,
+	}
+
+}
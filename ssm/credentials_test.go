@@ -0,0 +1,103 @@
+package ssm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+//TestAssumeRole assumes roles against a fake sts, and checks the parameters sent and the credentials returned
+func TestAssumeRole(t *testing.T) {
+
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		if strings.HasSuffix(form.Get("RoleArn"), "/denied") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<ErrorResponse><Error><Code>AccessDenied</Code></Error></ErrorResponse>"))
+			return
+		}
+		w.Write([]byte(`<AssumeRoleResponse><AssumeRoleResult><Credentials>
+			<AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2026-01-02T00:00:00Z</Expiration>
+		</Credentials></AssumeRoleResult></AssumeRoleResponse>`))
+	}))
+	defer server.Close()
+
+	if val, ok := os.LookupEnv("AWS_ENDPOINT_URL_STS"); ok {
+		defer os.Setenv("AWS_ENDPOINT_URL_STS", val)
+	} else {
+		defer os.Unsetenv("AWS_ENDPOINT_URL_STS")
+	}
+	os.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+
+	tests := []struct {
+		roleArn     string
+		externalID  string
+		sessionName string
+		wantSession string
+		err         string
+	}{
+		{"arn:aws:iam::123456789012:role/ops", "ext-123", "deploy", "deploy", ""},
+		{"arn:aws:iam::123456789012:role/ops", "", "", defaultSessionName, ""},
+		{"arn:aws:iam::123456789012:role/denied", "", "", defaultSessionName, "unable to assume role [arn:aws:iam::123456789012:role/denied]: "},
+	}
+
+	for _, test := range tests {
+		assumed, err := assumeRole(creds, test.roleArn, test.externalID, test.sessionName)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) || !strings.Contains(err.Error(), "AccessDenied") {
+				t.Errorf("assumeRole(%s) error = %v, want %s...AccessDenied", test.roleArn, err, test.err)
+			}
+		} else if err != nil || assumed.AccessKeyID != "ASIAEXAMPLE" || assumed.SessionToken != "token" || assumed.Expires.IsZero() {
+			t.Errorf("assumeRole(%s) = %+v (%v), want the assumed credentials", test.roleArn, assumed, err)
+		}
+		if form.Get("Action") != "AssumeRole" || form.Get("RoleArn") != test.roleArn || form.Get("RoleSessionName") != test.wantSession {
+			t.Errorf("assumeRole(%s) sent %v, want role %s and session %s", test.roleArn, form, test.roleArn, test.wantSession)
+		}
+		if _, sent := form["ExternalId"]; sent != (test.externalID != "") || form.Get("ExternalId") != test.externalID {
+			t.Errorf("assumeRole(%s) sent ExternalId %v, want [%s]", test.roleArn, form["ExternalId"], test.externalID)
+		}
+	}
+
+}
+
+func TestPatterns(t *testing.T) {
+
+	regions := map[string]bool{
+		"us-east-1":       true,
+		"eu-central-2":    true,
+		"us-gov-west-1":   true,
+		"cn-north-1":      true,
+		"ap-southeast-10": true,
+		"useast1":         false,
+		"us-east":         false,
+		"US-EAST-1":       false,
+	}
+	for region, valid := range regions {
+		if regionPattern.MatchString(region) != valid {
+			t.Errorf("regionPattern(%s) = %v, want %v", region, !valid, valid)
+		}
+	}
+
+	roleArns := map[string]bool{
+		"arn:aws:iam::123456789012:role/ops":                 true,
+		"arn:aws-us-gov:iam::123456789012:role/ops":          true,
+		"arn:aws-cn:iam::123456789012:role/path/ops@team":    true,
+		"arn:azure:iam::123456789012:role/ops":               false,
+		"arn:aws:iam::12345:role/ops":                        false,
+		"arn:aws:iam::123456789012:user/ops":                 false,
+		"arn:aws:sts::123456789012:assumed-role/ops/session": false,
+	}
+	for roleArn, valid := range roleArns {
+		if roleArnPattern.MatchString(roleArn) != valid {
+			t.Errorf("roleArnPattern(%s) = %v, want %v", roleArn, !valid, valid)
+		}
+	}
+
+}
@@ -4,39 +4,78 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/densify-quick-start/helm-optimize-resources/support"
 )
 
 var (
-	prefix  string
-	profile string
-	region  string
+	prefix          string
+	profile         string
+	region          string
+	endpoint        string
+	keyTemplate     string
+	roleArn         string
+	externalID      string
+	roleSessionName string
 )
 
-var supportedRegions = []string{"us-east-2", "us-east-1", "us-west-1", "us-west-2", "af-south-1", "ap-east-1", "ap-south-1", "ap-northeast-3", "ap-northeast-2", "ap-southeast-1", "ap-southeast-2", "ap-northeast-1", "ca-central-1", "cn-north-1", "cn-northwest-1", "eu-central-1", "eu-west-1", "eu-west-2", "eu-south-1", "eu-west-3", "eu-north-1", "me-south-1", "sa-east-1", "us-gov-east-1", "us-gov-west-1"}
+//defaultKeyTemplate is the parameter key layout used when no template is configured
+const defaultKeyTemplate = "/{cluster}/{namespace}/{kind}/{name}/{container}/resourceSpec"
+
+//keyPlaceholders are the placeholders supported by the key template
+var keyPlaceholders = []string{"{cluster}", "{namespace}", "{kind}", "{name}", "{container}", "{release}", "{chart}"}
+
+//releaseName and chartName are the values of the {release} and {chart} placeholders
+var (
+	releaseName string
+	chartName   string
+)
+
+//cachedParameter holds the latest version of a parameter and the approval label attached to it.
+//ApprovedVersion and ApprovedValue hold the version carrying the Approved label when it was found by the bulk fetch.
+type cachedParameter struct {
+	Value           string
+	Version         int64
+	Label           string
+	ApprovedVersion int64
+	ApprovedValue   string
+}
+
+//approvalLabels maps the parameter labels to their approval setting
+var approvalLabels = map[string]string{"Approved": "Approved", "NotApproved": "Not Approved"}
+
+//parameterCache holds the parameters fetched in bulk, keyed by name.  prefetched records the outcome of each subtree fetch.
+//tagCache and historyCache hold the tags and history read for each parameter, so they are read once per run.
+var (
+	parameterCache = make(map[string]cachedParameter)
+	prefetched     = make(map[string]error)
+	tagCache       = make(map[string]map[string]string)
+	historyCache   = make(map[string][]parameterVersion)
+)
+
+//regionPattern matches aws region names (eg. us-east-1, us-gov-west-1, cn-north-1), roleArnPattern iam role arns in any partition
+var (
+	regionPattern  = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]{1,2}$`)
+	roleArnPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[\w+=,.@/-]+$`)
+)
 
 ////////////////////////////////////////////////////////
 ////////////////EXTERNAL FUNCTIONS//////////////////////
 ////////////////////////////////////////////////////////
 
-//Initialize will ready the adapter to serve insight extraction from AWS parameter store.
-func Initialize() error {
-
-	//Check dependancies
-	if _, _, err := support.ExecuteSingleCommand([]string{"aws", "--version"}); err != nil {
-		return errors.New("aws-cli is not available - please install before trying again")
-	}
+//Initialize will ready the adapter to serve insight extraction from AWS parameter store, prompting for its settings unless they are stored (or reconfigure is set).
+func Initialize(reconfigure bool) error {
 
 	//check stored secret
 	storedSecrets := support.RetrieveSecrets("helm-optimize-plugin")
-	if storedSecrets != nil && storedSecrets["adapter"] == "Parameter Store" {
-		if _, ok := storedSecrets["region"]; ok {
-			region = storedSecrets["region"]
-			prefix = storedSecrets["prefix"]
-			profile = storedSecrets["profile"]
+	if !reconfigure && storedSecrets != nil && storedSecrets["adapter"] == "Parameter Store" {
+		if err := loadSecrets(storedSecrets); err == nil {
 			return nil
 		}
 	}
@@ -59,28 +98,91 @@ func Initialize() error {
 		break
 	}
 
+	for {
+		keyTemplate = ""
+		fmt.Print("What is your parameter key template [" + defaultKeyTemplate + "]: ")
+		fmt.Scanln(&keyTemplate)
+		if keyTemplate == "" {
+			keyTemplate = defaultKeyTemplate
+		}
+		if err := validateKeyTemplate(keyTemplate); err != nil {
+			fmt.Println("Invalid entry, " + err.Error() + ".  Supported placeholders are " + strings.Join(keyPlaceholders, ", ") + ".")
+			continue
+		}
+		break
+	}
+
+	endpoint = ""
+	fmt.Print("Parameter store endpoint, eg. a local ssm compatible stand-in [aws]: ")
+	fmt.Scanln(&endpoint)
+
 	for {
 		fmt.Print("What is your preferred AWS profile [default]: ")
 		fmt.Scanln(&profile)
 		if profile == "" {
 			profile = "default"
 		}
-		_, stdErr, err := support.ExecuteSingleCommand([]string{"aws", "sts", "get-caller-identity", "--profile", profile})
-		if found := support.CheckError(stdErr, err, false); !found {
-			break
+		//web identity credentials are resolved through the regional sts endpoint
+		if region = profileRegion(profile); region == "" {
+			region = "us-east-1"
+		}
+		roleArn, externalID, roleSessionName = "", "", ""
+		credentialCache, callerArn = nil, ""
+		if _, err := getCredentials(); err != nil {
+			fmt.Println(err.Error())
+			continue
 		}
+		break
 	}
 
+	//the region is validated by calling sts in that region, unless parameter store is a local stand-in (which may not serve sts)
+	defaultRegion := region
 	for {
-		fmt.Print("What is your preferred AWS region [us-east-1]: ")
+		region = ""
+		fmt.Print("What is your preferred AWS region [" + defaultRegion + "]: ")
 		fmt.Scanln(&region)
 		if region == "" {
-			region = "us-east-1"
+			region = defaultRegion
 		}
-		if _, ok := support.InSlice(supportedRegions, region); !ok {
+		if !regionPattern.MatchString(region) {
 			fmt.Println("Invalid entry.  Check for valid regions here https://aws.amazon.com/about-aws/global-infrastructure/regions_az/.")
 			continue
 		}
+		callerArn = ""
+		if endpoint == "" {
+			if _, err := getCallerIdentity(); err != nil {
+				fmt.Println("Unable to reach AWS in region [" + region + "]: " + err.Error())
+				continue
+			}
+		}
+		break
+	}
+
+	for {
+		roleArn, externalID, roleSessionName = "", "", ""
+		fmt.Print("Role ARN to assume for parameter store calls, eg. in a central tooling account [none]: ")
+		fmt.Scanln(&roleArn)
+		if roleArn == "" {
+			break
+		}
+		if !roleArnPattern.MatchString(roleArn) {
+			fmt.Println("Invalid entry.  e.g arn:aws:iam::123456789012:role/helm-optimize")
+			continue
+		}
+		fmt.Print("External ID [none]: ")
+		fmt.Scanln(&externalID)
+		fmt.Print("Role session name [" + defaultSessionName + "]: ")
+		fmt.Scanln(&roleSessionName)
+
+		credentialCache, callerArn = nil, ""
+		if endpoint == "" {
+			arn, err := getCallerIdentity()
+			if err != nil {
+				fmt.Println("Unable to assume role: " + err.Error())
+				continue
+			}
+			fmt.Println("Assumed " + arn)
+		}
 		break
 	}
 
@@ -90,34 +192,330 @@ func Initialize() error {
 
 }
 
+//Load readies the adapter from the stored secret without prompting, even if parameter store is not the selected adapter.
+func Load() error {
+
+	storedSecrets := support.RetrieveSecrets("helm-optimize-plugin")
+	if storedSecrets == nil {
+		return errors.New("parameter store is not configured - select the Parameter Store adapter with helm optimize -c --adapter")
+	}
+
+	return loadSecrets(storedSecrets)
+
+}
+
+//SetReleaseContext sets the release and chart used to resolve the {release} and {chart} placeholders of the key template.
+func SetReleaseContext(release string, chart string) {
+	releaseName = release
+	chartName = chart
+}
+
 //GetInsight gets an insight from parameter store based on the keys cluster, namespace, objType, objName and containerName
 func GetInsight(cluster string, namespace string, objType string, objName string, containerName string) (map[string]map[string]string, string, error) {
 
-	ssmKey := prefix + "/" + cluster + "/" + namespace + "/" + objType + "/" + objName + "/" + containerName + "/resourceSpec"
+	ssmKey := parameterKey(cluster, namespace, objType, objName, containerName)
+
+	return getInsightByKey(keySubtree(cluster, namespace), ssmKey)
+
+}
+
+//GetPodInsight gets a pod-level insight from parameter store based on the keys cluster, namespace, objType and objName
+func GetPodInsight(cluster string, namespace string, objType string, objName string) (map[string]map[string]string, string, error) {
+
+	ssmKey := parameterKey(cluster, namespace, objType, objName, "")
+
+	return getInsightByKey(keySubtree(cluster, namespace), ssmKey)
+
+}
+
+//GetInsightMeta gets the audit metadata of an insight.  Parameter store does not hold audit metadata.
+func GetInsightMeta(cluster string, namespace string, objType string, objName string, containerName string) (support.InsightMeta, error) {
+	return support.InsightMeta{}, errors.New("audit metadata not supported by adapter")
+}
+
+//UpdateApprovalSetting records the approval setting in the tags of the parameter, with the approved version and who approved it (or who withdrew the approval).
+//The parameter value (the recommended spec) is left untouched.
+func UpdateApprovalSetting(approved bool, cluster string, namespace string, objType string, objName string, containerName string) error {
+
+	ssmKey := parameterKey(cluster, namespace, objType, objName, containerName)
+
+	parameter, err := lookupParameter(keySubtree(cluster, namespace), ssmKey)
+	if err != nil {
+		return errors.New("unable to update approval setting")
+	}
+
+	label := "NotApproved"
+	if approved == true {
+		label = "Approved"
+	}
+
+	tags, staleTags := approvalTags(label, parameter.Version)
+	err = callSSM("AddTagsToResource", map[string]interface{}{"ResourceType": "Parameter", "ResourceId": ssmKey, "Tags": tags}, nil)
+	if err == nil {
+		err = callSSM("RemoveTagsFromResource", map[string]interface{}{"ResourceType": "Parameter", "ResourceId": ssmKey, "TagKeys": staleTags}, nil)
+	}
+	delete(tagCache, ssmKey)
+	if err != nil {
+		return errors.New("unable to update approval setting")
+	}
+
+	//the label keeps the approval visible in the console, it is not required (eg. the version already carries the maximum number of labels)
+	callSSM("LabelParameterVersion", map[string]interface{}{"Name": ssmKey, "ParameterVersion": parameter.Version, "Labels": []string{label}}, nil)
+	delete(historyCache, ssmKey)
+
+	parameter.Label = approvalLabels[label]
+	parameterCache[ssmKey] = parameter
+
+	return nil
+
+}
+
+//SeedParameter creates the parameter of a container from its current resources (k8s quantities).  The current spec is also the initial
+//recommendation, and is not approved.  Existing parameters are left untouched, in which case false is returned.
+func SeedParameter(cluster string, namespace string, objType string, objName string, containerName string, resources map[string]map[string]string) (bool, error) {
+
+	ssmKey := parameterKey(cluster, namespace, objType, objName, containerName)
+
+	spec, err := storedSpec(resources)
+	if err != nil {
+		return false, errors.New("current spec does not define " + err.Error())
+	}
+
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return false, err
+	}
+
+	//a new parameter always starts at version 1
+	approval, _ := approvalTags("NotApproved", 1)
+	tags := append(append(tagsFromSpec(spec, "current"), tagsFromSpec(spec, "recommended")...), approval...)
+	if err := callSSM("PutParameter", map[string]interface{}{"Name": ssmKey, "Type": "String", "Value": string(specJSON), "Tags": tags}, nil); err != nil {
+		if strings.HasPrefix(err.Error(), "ParameterAlreadyExists") {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+//SyncParameter mirrors a recommendation (k8s quantities) into the parameter of a container.  The recommended spec is written as a new version
+//when it changes, and the current spec and approval tags are only written when they differ, so syncing unchanged recommendations is a no-op.
+//Returns created, updated or unchanged.
+func SyncParameter(cluster string, namespace string, objType string, objName string, containerName string, current map[string]map[string]string, recommended map[string]map[string]string, approved bool) (string, error) {
+
+	ssmKey := parameterKey(cluster, namespace, objType, objName, containerName)
+
+	recommendedSpec, err := storedSpec(recommended)
+	if err != nil {
+		return "", errors.New("recommended spec does not define " + err.Error())
+	}
+	recommendedJSON, err := json.Marshal(recommendedSpec)
+	if err != nil {
+		return "", err
+	}
+
+	var tags []map[string]string
+	if currentSpec, err := storedSpec(current); err == nil {
+		tags = tagsFromSpec(currentSpec, "current")
+	}
+	tags = append(tags, tagsFromSpec(recommendedSpec, "recommended")...)
+
+	label := "NotApproved"
+	if approved {
+		label = "Approved"
+	}
 
-	insight, insightVersion, err := getParameterValue(ssmKey)
+	parameter, err := lookupParameter(keySubtree(cluster, namespace), ssmKey)
+	if err != nil {
+		//a new parameter always starts at version 1
+		approval, _ := approvalTags(label, 1)
+		tags = append(tags, approval...)
+		if err := callSSM("PutParameter", map[string]interface{}{"Name": ssmKey, "Type": "String", "Value": string(recommendedJSON), "Tags": tags}, nil); err != nil {
+			return "", err
+		}
+		callSSM("LabelParameterVersion", map[string]interface{}{"Name": ssmKey, "ParameterVersion": 1, "Labels": []string{label}}, nil)
+		parameterCache[ssmKey] = cachedParameter{Value: string(recommendedJSON), Version: 1, Label: approvalLabels[label]}
+		return "created", nil
+	}
+
+	status := "unchanged"
+
+	var existingSpec map[string]map[string]string
+	json.Unmarshal([]byte(parameter.Value), &existingSpec)
+	if !reflect.DeepEqual(existingSpec, recommendedSpec) {
+		var putResult struct {
+			Version int64
+		}
+		if err := callSSM("PutParameter", map[string]interface{}{"Name": ssmKey, "Type": "String", "Value": string(recommendedJSON), "Overwrite": true}, &putResult); err != nil {
+			return "", err
+		}
+		parameter.Value, parameter.Version, parameter.Label = string(recommendedJSON), putResult.Version, ""
+		delete(historyCache, ssmKey)
+		status = "updated"
+	}
+
+	existingTags, err := getParameterTags(ssmKey)
+	if err != nil {
+		return "", err
+	}
+
+	//the approval is only rewritten when it changes, so the approvedBy/unapprovedBy and approvedAt/unapprovedAt tags keep recording the original change
+	var staleTags []string
+	if existingTags["approval"] != label || (approved && existingTags["approvedVersion"] != strconv.FormatInt(parameter.Version, 10)) {
+		approval, stale := approvalTags(label, parameter.Version)
+		tags = append(tags, approval...)
+		for _, key := range stale {
+			if _, ok := existingTags[key]; ok {
+				staleTags = append(staleTags, key)
+			}
+		}
+		callSSM("LabelParameterVersion", map[string]interface{}{"Name": ssmKey, "ParameterVersion": parameter.Version, "Labels": []string{label}}, nil)
+		delete(historyCache, ssmKey)
+		parameter.Label = approvalLabels[label]
+	}
+
+	var changedTags []map[string]string
+	for _, tag := range tags {
+		if existingTags[tag["Key"]] != tag["Value"] {
+			changedTags = append(changedTags, tag)
+		}
+	}
+	if len(changedTags) > 0 {
+		err := callSSM("AddTagsToResource", map[string]interface{}{"ResourceType": "Parameter", "ResourceId": ssmKey, "Tags": changedTags}, nil)
+		delete(tagCache, ssmKey)
+		if err != nil {
+			return "", err
+		}
+		status = "updated"
+	}
+	if len(staleTags) > 0 {
+		err := callSSM("RemoveTagsFromResource", map[string]interface{}{"ResourceType": "Parameter", "ResourceId": ssmKey, "TagKeys": staleTags}, nil)
+		delete(tagCache, ssmKey)
+		if err != nil {
+			return "", err
+		}
+		status = "updated"
+	}
+
+	parameterCache[ssmKey] = parameter
+
+	return status, nil
+
+}
+
+//GetApprovalSetting will acquire the current approval setting, along with the approved version and who approved it (or who withdrew the approval)
+func GetApprovalSetting(cluster string, namespace string, objType string, objName string, containerName string) (string, error) {
+
+	ssmKey := parameterKey(cluster, namespace, objType, objName, containerName)
+
+	parameter, err := lookupParameter(keySubtree(cluster, namespace), ssmKey)
+	if err != nil {
+		return "", errors.New("unable to read approval setting")
+	}
+
+	tags, err := getParameterTags(ssmKey)
+	if err != nil {
+		return "", errors.New("unable to read approval setting")
+	}
+
+	setting, ok := approvalLabels[tags["approval"]]
+	if !ok {
+		//parameters approved by earlier versions of the plugin only carry a label
+		if parameter.Label == "" {
+			return "", errors.New("unable to read approval setting")
+		}
+		return parameter.Label, nil
+	}
+
+	if setting == "Not Approved" {
+		if tags["unapprovedBy"] == "" {
+			return setting, nil
+		}
+		return setting + " (by " + tags["unapprovedBy"] + " at " + tags["unapprovedAt"] + ")", nil
+	}
+
+	details := "version " + tags["approvedVersion"] + " by " + tags["approvedBy"] + " at " + tags["approvedAt"]
+	if tags["approvedVersion"] != strconv.FormatInt(parameter.Version, 10) {
+		details += ", version " + strconv.FormatInt(parameter.Version, 10) + " awaiting approval"
+		version, _ := strconv.ParseInt(tags["approvedVersion"], 10, 64)
+		if _, err := approvedValue(ssmKey, parameter, version); err != nil {
+			details += " - " + err.Error()
+		}
+	}
+
+	return setting + " (" + details + ")", nil
+
+}
+
+////////////////////////////////////////////////////////
+///////////////////LOCAL FUNCTIONS//////////////////////
+////////////////////////////////////////////////////////
+
+//getInsightByKey resolves the spec to apply from the approval recorded in the tags of the parameter.
+//Approved parameters apply the approved version of the recommended spec, not approved parameters apply the current spec held in the tags.
+func getInsightByKey(subtree string, ssmKey string) (map[string]map[string]string, string, error) {
+
+	parameter, err := lookupParameter(subtree, ssmKey)
 	if err != nil {
 		return nil, "", errors.New("could not locate resource spec")
 	}
 
-	//Validate and acquire resource spec
-	var parsedInsight map[string]map[string]string
-	json.Unmarshal([]byte(insight), &parsedInsight)
+	tags, err := getParameterTags(ssmKey)
+	if err != nil {
+		return nil, "", errors.New("unable to read approval setting")
+	}
+
+	var spec map[string]map[string]string
+	approvalSetting := parameter.Label
+	switch tags["approval"] {
+	case "Approved":
+		approvalSetting = "Approved"
+		version, _ := strconv.ParseInt(tags["approvedVersion"], 10, 64)
+		value, err := approvedValue(ssmKey, parameter, version)
+		if err != nil {
+			return nil, "", err
+		}
+		json.Unmarshal([]byte(value), &spec)
+	case "NotApproved":
+		approvalSetting = "Not Approved"
+		spec = specFromTags(tags, "current")
+	default:
+		//parameters approved by earlier versions of the plugin only carry a label, and hold the spec to apply as value
+		json.Unmarshal([]byte(parameter.Value), &spec)
+	}
+
+	if approvalSetting == "" {
+		return nil, "", errors.New("unable to read approval setting")
+	}
+
+	parsedInsight, err := parseSpec(spec)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return parsedInsight, approvalSetting, nil
+
+}
+
+//parseSpec validates a spec held in parameter store (millicores and Mi) and converts it into k8s quantities
+func parseSpec(parsedInsight map[string]map[string]string) (map[string]map[string]string, error) {
 
 	if cpuLimit, err := strconv.Atoi(parsedInsight["limits"]["cpu"]); err != nil || cpuLimit < 1 {
-		return nil, "", errors.New("invalid resource specs received from repository")
+		return nil, errors.New("invalid resource specs received from repository")
 	}
 
 	if memLimit, err := strconv.Atoi(parsedInsight["limits"]["memory"]); err != nil || memLimit < 1 {
-		return nil, "", errors.New("invalid resource specs received from repository")
+		return nil, errors.New("invalid resource specs received from repository")
 	}
 
 	if cpuRequest, err := strconv.Atoi(parsedInsight["requests"]["cpu"]); err != nil || cpuRequest < 1 {
-		return nil, "", errors.New("invalid resource specs received from repository")
+		return nil, errors.New("invalid resource specs received from repository")
 	}
 
 	if memRequest, err := strconv.Atoi(parsedInsight["requests"]["memory"]); err != nil || memRequest < 1 {
-		return nil, "", errors.New("invalid resource specs received from repository")
+		return nil, errors.New("invalid resource specs received from repository")
 	}
 
 	parsedInsight["limits"]["cpu"] = parsedInsight["limits"]["cpu"] + "m"
@@ -125,137 +523,347 @@ func GetInsight(cluster string, namespace string, objType string, objName string
 	parsedInsight["requests"]["cpu"] = parsedInsight["requests"]["cpu"] + "m"
 	parsedInsight["requests"]["memory"] = parsedInsight["requests"]["memory"] + "Mi"
 
-	//Acquire approval setting
-	approvalSetting, err := getParameterLabel(ssmKey, insightVersion)
-	if err != nil {
-		return nil, "", errors.New("unable to read approval setting")
+	return parsedInsight, nil
+
+}
+
+//storedSpec converts a spec of k8s quantities into the spec held in parameter store (millicores and Mi)
+func storedSpec(resources map[string]map[string]string) (map[string]map[string]string, error) {
+
+	spec := make(map[string]map[string]string)
+	for _, field := range []string{"limits", "requests"} {
+		spec[field] = make(map[string]string)
+		for _, resource := range []string{"cpu", "memory"} {
+			quantity, err := support.ParseQuantity(resources[field][resource])
+			if err != nil || quantity <= 0 {
+				return nil, errors.New(field + "." + resource)
+			}
+			if resource == "cpu" {
+				spec[field][resource] = strconv.FormatFloat(math.Ceil(math.Round(quantity*1e9)/1e6), 'f', -1, 64)
+			} else {
+				spec[field][resource] = strconv.FormatFloat(math.Ceil(quantity/(1<<20)), 'f', -1, 64)
+			}
+		}
 	}
 
-	return parsedInsight, approvalSetting, nil
+	return spec, nil
 
 }
 
-//UpdateApprovalSetting will update the approval setting accordingly
-func UpdateApprovalSetting(approved bool, cluster string, namespace string, objType string, objName string, containerName string) error {
+//tagsFromSpec converts a spec into the current* or recommended* tags of a parameter
+func tagsFromSpec(spec map[string]map[string]string, tagPrefix string) []map[string]string {
+
+	return []map[string]string{
+		{"Key": tagPrefix + "CpuLimit", "Value": spec["limits"]["cpu"]},
+		{"Key": tagPrefix + "MemLimit", "Value": spec["limits"]["memory"]},
+		{"Key": tagPrefix + "CpuRequest", "Value": spec["requests"]["cpu"]},
+		{"Key": tagPrefix + "MemRequest", "Value": spec["requests"]["memory"]},
+	}
+
+}
 
-	ssmKey := prefix + "/" + cluster + "/" + namespace + "/" + objType + "/" + objName + "/" + containerName + "/resourceSpec"
+//approvalTags builds the tags recording an approval setting (Approved or NotApproved) of a version and who set it, along with the keys of the
+//tags recording the opposite setting, which no longer apply
+func approvalTags(label string, version int64) ([]map[string]string, []string) {
 
-	resp, _, err := support.ExecuteSingleCommand([]string{"aws", "ssm", "list-tags-for-resource", "--resource-type", "Parameter", "--resource-id", ssmKey, "--profile", profile, "--region", region, "--query", "TagList"})
+	changedBy, err := getCallerIdentity()
 	if err != nil {
-		return errors.New("unable to update approval setting")
+		changedBy = "unknown"
+	}
+	changedAt := time.Now().UTC().Format(time.RFC3339)
+
+	if label == "NotApproved" {
+		return []map[string]string{
+			{"Key": "approval", "Value": label},
+			{"Key": "unapprovedBy", "Value": changedBy},
+			{"Key": "unapprovedAt", "Value": changedAt},
+		}, []string{"approvedVersion", "approvedBy", "approvedAt"}
 	}
 
-	var tagMap []map[string]string
-	json.Unmarshal([]byte(resp), &tagMap)
-
-	currentSettings := make(map[string]map[string]string)
-	recommendedSettings := make(map[string]map[string]string)
-	currentSettings["limits"] = make(map[string]string)
-	currentSettings["requests"] = make(map[string]string)
-	recommendedSettings["limits"] = make(map[string]string)
-	recommendedSettings["requests"] = make(map[string]string)
-	for _, val := range tagMap {
-		if val["Key"] == "currentCpuLimit" {
-			currentSettings["limits"]["cpu"] = val["Value"]
-		} else if val["Key"] == "currentMemLimit" {
-			currentSettings["limits"]["memory"] = val["Value"]
-		} else if val["Key"] == "currentCpuRequest" {
-			currentSettings["requests"]["cpu"] = val["Value"]
-		} else if val["Key"] == "currentMemRequest" {
-			currentSettings["requests"]["memory"] = val["Value"]
-		} else if val["Key"] == "recommendedCpuLimit" {
-			recommendedSettings["limits"]["cpu"] = val["Value"]
-		} else if val["Key"] == "recommendedMemLimit" {
-			recommendedSettings["limits"]["memory"] = val["Value"]
-		} else if val["Key"] == "recommendedCpuRequest" {
-			recommendedSettings["requests"]["cpu"] = val["Value"]
-		} else if val["Key"] == "recommendedMemRequest" {
-			recommendedSettings["requests"]["memory"] = val["Value"]
-		}
-	}
-
-	var err1, err2 error
-	if approved == true {
-		recommendedSettingsJSON, err := json.Marshal(recommendedSettings)
-		if err != nil {
-			return errors.New("unable to update approval setting")
+	return []map[string]string{
+		{"Key": "approval", "Value": label},
+		{"Key": "approvedVersion", "Value": strconv.FormatInt(version, 10)},
+		{"Key": "approvedBy", "Value": changedBy},
+		{"Key": "approvedAt", "Value": changedAt},
+	}, []string{"unapprovedBy", "unapprovedAt"}
+
+}
+
+//specFromTags builds a spec from the current* or recommended* tags of a parameter
+func specFromTags(tags map[string]string, tagPrefix string) map[string]map[string]string {
+
+	return map[string]map[string]string{
+		"limits": {
+			"cpu":    tags[tagPrefix+"CpuLimit"],
+			"memory": tags[tagPrefix+"MemLimit"],
+		},
+		"requests": {
+			"cpu":    tags[tagPrefix+"CpuRequest"],
+			"memory": tags[tagPrefix+"MemRequest"],
+		},
+	}
+
+}
+
+//parameterKey renders the key template for a container.  Pod-level keys (no container) drop the {container} segment.
+func parameterKey(cluster string, namespace string, objType string, objName string, containerName string) string {
+
+	template := keyTemplate
+	if containerName == "" {
+		template = strings.Replace(template, "/{container}", "", 1)
+	}
+
+	return prefix + renderKey(template, cluster, namespace, objType, objName, containerName)
+
+}
+
+//keySubtree returns the path shared by every key of the namespace, ie. the key template up to the first workload specific placeholder.
+func keySubtree(cluster string, namespace string) string {
+
+	template := keyTemplate
+	for _, placeholder := range []string{"{kind}", "{name}", "{container}"} {
+		if idx := strings.Index(template, placeholder); idx >= 0 {
+			template = template[:idx]
 		}
-		_, _, err1 = support.ExecuteSingleCommand([]string{"aws", "ssm", "put-parameter", "--name", ssmKey, "--type", "String", "--value", string(recommendedSettingsJSON), "--overwrite", "--profile", profile, "--region", region})
-		if err1 == nil {
-			_, _, err2 = support.ExecuteSingleCommand([]string{"aws", "ssm", "label-parameter-version", "--name", ssmKey, "--labels", "Approved", "--profile", profile, "--region", region})
+	}
+	template = template[:strings.LastIndex(template, "/")+1]
+
+	return strings.TrimSuffix(prefix+renderKey(template, cluster, namespace, "", "", ""), "/")
+
+}
+
+func renderKey(template string, cluster string, namespace string, objType string, objName string, containerName string) string {
+
+	return strings.NewReplacer(
+		"{cluster}", cluster,
+		"{namespace}", namespace,
+		"{kind}", objType,
+		"{name}", objName,
+		"{container}", containerName,
+		"{release}", releaseName,
+		"{chart}", chartName,
+	).Replace(template)
+
+}
+
+func validateKeyTemplate(template string) error {
+
+	if !strings.Contains(template, "/{container}") {
+		return errors.New("key template must contain a /{container} segment")
+	}
+
+	if res, _ := regexp.MatchString("^(/{1}[a-zA-Z0-9_.{}-]+)*$", template); !res {
+		return errors.New("key template must be a path of letters, numbers, placeholders and the symbols .-_  e.g /{namespace}/{name}/{container}/resources")
+	}
+
+	for _, placeholder := range regexp.MustCompile("{[^}]*}").FindAllString(template, -1) {
+		if _, ok := support.InSlice(keyPlaceholders, placeholder); !ok {
+			return errors.New("key template contains unknown placeholder " + placeholder)
+		}
+	}
+
+	return nil
+
+}
+
+//lookupParameter resolves a parameter from the bulk fetch of its subtree (see keySubtree).
+//If the subtree could not be fetched in bulk (eg. missing ssm:GetParametersByPath permission), the parameter is fetched by key.
+func lookupParameter(subtree string, ssmKey string) (cachedParameter, error) {
+
+	if subtree == "" {
+		prefetched[subtree] = errors.New("no subtree to fetch in bulk")
+	} else if _, ok := prefetched[subtree]; !ok {
+		prefetched[subtree] = prefetchSubtree(subtree)
+	}
+
+	if prefetched[subtree] == nil && strings.HasPrefix(ssmKey, subtree+"/") {
+		if parameter, ok := parameterCache[ssmKey]; ok {
+			return parameter, nil
 		}
-	} else {
-		currentSettingsJSON, err := json.Marshal(currentSettings)
+		return cachedParameter{}, errors.New("could not locate resource spec")
+	}
+
+	value, version, err := getParameterValue(ssmKey)
+	if err != nil {
+		return cachedParameter{}, err
+	}
+
+	//a missing label is reported by the caller
+	label, _ := getParameterLabel(ssmKey, version)
+
+	return cachedParameter{Value: value, Version: version, Label: label}, nil
+
+}
+
+//prefetchSubtree fetches every parameter under the subtree, then resolves the approval labels in bulk.
+//A label can only be attached to one version of a parameter, so it applies when it is attached to the latest version.
+func prefetchSubtree(subtree string) error {
+
+	latest, err := getParametersByPath(subtree, "")
+	if err != nil {
+		return err
+	}
+
+	for _, label := range []string{"Approved", "NotApproved"} {
+		labelled, err := getParametersByPath(subtree, label)
 		if err != nil {
-			return errors.New("unable to update approval setting")
+			return err
 		}
-		_, _, err1 = support.ExecuteSingleCommand([]string{"aws", "ssm", "put-parameter", "--name", ssmKey, "--type", "String", "--value", string(currentSettingsJSON), "--overwrite", "--profile", profile, "--region", region})
-		if err1 == nil {
-			_, _, err2 = support.ExecuteSingleCommand([]string{"aws", "ssm", "label-parameter-version", "--name", ssmKey, "--labels", "NotApproved", "--profile", profile, "--region", region})
+		for name, parameter := range labelled {
+			current, ok := latest[name]
+			if !ok {
+				continue
+			}
+			//the approved version is kept, so an approval of an older version does not need the parameter history
+			if label == "Approved" {
+				current.ApprovedVersion, current.ApprovedValue = parameter.Version, parameter.Value
+			}
+			if current.Version == parameter.Version {
+				current.Label = approvalLabels[label]
+			}
+			latest[name] = current
 		}
 	}
 
-	if err1 != nil || err2 != nil {
-		return errors.New("unable to update approval setting")
+	for name, parameter := range latest {
+		parameterCache[name] = parameter
 	}
 
 	return nil
 
 }
 
-//GetApprovalSetting will acquire the current approval setting
-func GetApprovalSetting(cluster string, namespace string, objType string, objName string, containerName string) (string, error) {
+//getParametersByPath fetches every parameter under the path, optionally limited to the versions carrying a label
+func getParametersByPath(path string, label string) (map[string]cachedParameter, error) {
 
-	ssmKey := prefix + "/" + cluster + "/" + namespace + "/" + objType + "/" + objName + "/" + containerName + "/resourceSpec"
+	parameters := make(map[string]cachedParameter)
 
-	_, insightVersion, err := getParameterValue(ssmKey)
-	if err != nil {
-		return "", errors.New("unable to read approval setting")
+	input := map[string]interface{}{"Path": path, "Recursive": true, "WithDecryption": true}
+	if label != "" {
+		input["ParameterFilters"] = []map[string]interface{}{{"Key": "Label", "Option": "Equals", "Values": []string{label}}}
 	}
 
-	//Acquire approval setting
-	approvalSetting, err := getParameterLabel(ssmKey, insightVersion)
-	if err != nil {
-		return "", errors.New("unable to read approval setting")
+	for {
+		var result struct {
+			Parameters []struct {
+				Name    string
+				Value   string
+				Version int64
+			}
+			NextToken string
+		}
+		if err := callSSM("GetParametersByPath", input, &result); err != nil {
+			return nil, err
+		}
+
+		for _, val := range result.Parameters {
+			parameters[val.Name] = cachedParameter{Value: val.Value, Version: val.Version}
+		}
+
+		if result.NextToken == "" {
+			break
+		}
+		input["NextToken"] = result.NextToken
 	}
 
-	return approvalSetting, nil
+	return parameters, nil
 
 }
 
-////////////////////////////////////////////////////////
-///////////////////LOCAL FUNCTIONS//////////////////////
-////////////////////////////////////////////////////////
+func getParameterValue(ssmKey string) (string, int64, error) {
+
+	var result struct {
+		Parameter struct {
+			Value   string
+			Version int64
+		}
+	}
+	if err := callSSM("GetParameter", map[string]interface{}{"Name": ssmKey, "WithDecryption": true}, &result); err != nil {
+		return "", 0, errors.New("could not locate resource spec")
+	}
+
+	return result.Parameter.Value, result.Parameter.Version, nil
+
+}
+
+//parameterVersion holds a version of a parameter as returned by the parameter history
+type parameterVersion struct {
+	Version int64
+	Value   string
+	Labels  []string
+}
+
+func getParameterHistory(ssmKey string) ([]parameterVersion, error) {
+
+	if history, ok := historyCache[ssmKey]; ok {
+		return history, nil
+	}
+
+	var history []parameterVersion
+
+	input := map[string]interface{}{"Name": ssmKey, "WithDecryption": true}
+	for {
+		var result struct {
+			Parameters []parameterVersion
+			NextToken  string
+		}
+		if err := callSSM("GetParameterHistory", input, &result); err != nil {
+			return nil, err
+		}
+		history = append(history, result.Parameters...)
+
+		if result.NextToken == "" {
+			break
+		}
+		input["NextToken"] = result.NextToken
+	}
+	historyCache[ssmKey] = history
 
-func getParameterValue(ssmKey string) (string, string, error) {
+	return history, nil
+
+}
+
+//approvedValue reads the value of the approved version, from the bulk fetch when it found the version, otherwise from the parameter history.
+//Parameter store only keeps the last 100 versions, so an approved version can roll out of the history and can no longer be applied.
+func approvedValue(ssmKey string, parameter cachedParameter, version int64) (string, error) {
+
+	switch version {
+	case parameter.Version:
+		return parameter.Value, nil
+	case parameter.ApprovedVersion:
+		return parameter.ApprovedValue, nil
+	}
 
-	insight, _, err := support.ExecuteSingleCommand([]string{"aws", "ssm", "get-parameter", "--with-decryption", "--name", ssmKey, "--profile", profile, "--region", region})
+	history, err := getParameterHistory(ssmKey)
 	if err != nil {
-		return "", "", errors.New("could not locate resource spec")
+		return "", errors.New("unable to read approved version " + strconv.FormatInt(version, 10))
 	}
 
-	var insightMap map[string]map[string]interface{}
-	json.Unmarshal([]byte(insight), &insightMap)
+	for _, val := range history {
+		if val.Version == version {
+			return val.Value, nil
+		}
+	}
 
-	return insightMap["Parameter"]["Value"].(string), strconv.FormatFloat(insightMap["Parameter"]["Version"].(float64), 'E', -1, 64), nil
+	return "", errors.New("approved version " + strconv.FormatInt(version, 10) + " is no longer in the parameter history (parameter store keeps the last 100 versions) - approve the latest version again")
 
 }
 
-func getParameterLabel(ssmKey string, version string) (string, error) {
+//getParameterLabel reads the approval label of a version.  Other labels attached to the version are ignored.
+func getParameterLabel(ssmKey string, version int64) (string, error) {
 
-	paramHistory, _, err := support.ExecuteSingleCommand([]string{"aws", "ssm", "get-parameter-history", "--with-decryption", "--name", ssmKey, "--profile", profile, "--region", region, "--query", "Parameters"})
+	history, err := getParameterHistory(ssmKey)
 	if err != nil {
 		return "", errors.New("unable to read approval setting")
 	}
 
-	var paramHistoryMap []map[string]interface{}
-	json.Unmarshal([]byte(paramHistory), &paramHistoryMap)
-	for _, val := range paramHistoryMap {
-		if strconv.FormatFloat(val["Version"].(float64), 'E', -1, 64) == version && len(val["Labels"].([]interface{})) == 1 {
-			if val["Labels"].([]interface{})[0].(string) == "NotApproved" {
-				return "Not Approved", nil
-			} else if val["Labels"].([]interface{})[0].(string) == "Approved" {
-				return "Approved", nil
+	for _, val := range history {
+		if val.Version != version {
+			continue
+		}
+		for _, label := range val.Labels {
+			if setting, ok := approvalLabels[label]; ok {
+				return setting, nil
 			}
 		}
 	}
@@ -264,6 +872,50 @@ func getParameterLabel(ssmKey string, version string) (string, error) {
 
 }
 
+func getParameterTags(ssmKey string) (map[string]string, error) {
+
+	if tags, ok := tagCache[ssmKey]; ok {
+		return tags, nil
+	}
+
+	var result struct {
+		TagList []map[string]string
+	}
+	if err := callSSM("ListTagsForResource", map[string]string{"ResourceType": "Parameter", "ResourceId": ssmKey}, &result); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range result.TagList {
+		tags[tag["Key"]] = tag["Value"]
+	}
+	tagCache[ssmKey] = tags
+
+	return tags, nil
+
+}
+
+func loadSecrets(storedSecrets map[string]string) error {
+
+	if _, ok := storedSecrets["region"]; !ok {
+		return errors.New("parameter store is not configured - select the Parameter Store adapter with helm optimize -c --adapter")
+	}
+
+	region = storedSecrets["region"]
+	prefix = storedSecrets["prefix"]
+	profile = storedSecrets["profile"]
+	endpoint = storedSecrets["endpoint"]
+	roleArn = storedSecrets["roleArn"]
+	externalID = storedSecrets["externalId"]
+	roleSessionName = storedSecrets["roleSessionName"]
+	if keyTemplate = storedSecrets["keyTemplate"]; keyTemplate == "" {
+		keyTemplate = defaultKeyTemplate
+	}
+
+	return nil
+
+}
+
 func storeSecrets() {
 
 	secrets := make(map[string]string)
@@ -271,6 +923,21 @@ func storeSecrets() {
 	secrets["profile"] = profile
 	secrets["prefix"] = prefix
 	secrets["region"] = region
+	secrets["keyTemplate"] = keyTemplate
+
+	//optional settings are removed when not configured
+	optional := map[string]string{"endpoint": endpoint, "roleArn": roleArn, "externalId": externalID, "roleSessionName": roleSessionName}
+	for key, val := range optional {
+		if val != "" {
+			secrets[key] = val
+		}
+	}
 	support.StoreSecrets("helm-optimize-plugin", secrets)
 
+	for key, val := range optional {
+		if val == "" {
+			support.RemoveSecretData("helm-optimize-plugin", key)
+		}
+	}
+
 }
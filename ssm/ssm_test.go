@@ -0,0 +1,325 @@
+package ssm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParameterKey(t *testing.T) {
+
+	defer func(originalPrefix string, originalTemplate string) {
+		prefix, keyTemplate = originalPrefix, originalTemplate
+	}(prefix, keyTemplate)
+	SetReleaseContext("rel", "chart")
+	defer SetReleaseContext("", "")
+
+	tests := []struct {
+		prefix    string
+		template  string
+		container string
+		key       string
+		subtree   string
+	}{
+		{"", defaultKeyTemplate, "app", "/c1/ns/Deployment/web/app/resourceSpec", "/c1/ns"},
+		{"", defaultKeyTemplate, "", "/c1/ns/Deployment/web/resourceSpec", "/c1/ns"},
+		{"/team", "/{namespace}/{name}/{container}", "app", "/team/ns/web/app", "/team/ns"},
+		{"", "/{release}/{chart}/{namespace}/{kind}-{name}/{container}", "app", "/rel/chart/ns/Deployment-web/app", "/rel/chart/ns"},
+		{"", "/{name}/{container}", "app", "/web/app", ""},
+	}
+
+	for _, test := range tests {
+		prefix, keyTemplate = test.prefix, test.template
+		if key := parameterKey("c1", "ns", "Deployment", "web", test.container); key != test.key {
+			t.Errorf("parameterKey(%s) = %s, want %s", test.template, key, test.key)
+		}
+		if subtree := keySubtree("c1", "ns"); subtree != test.subtree {
+			t.Errorf("keySubtree(%s) = %s, want %s", test.template, subtree, test.subtree)
+		}
+	}
+
+}
+
+//TestApprovalLookups reads the approvals of a namespace against a fake parameter store, and checks each parameter costs one tag lookup
+func TestApprovalLookups(t *testing.T) {
+
+	type version struct {
+		Name    string
+		Value   string
+		Version int64
+		Labels  []string
+	}
+	spec := func(cpu string) string {
+		return `{"limits":{"cpu":"` + cpu + `","memory":"512"},"requests":{"cpu":"` + cpu + `","memory":"256"}}`
+	}
+
+	//approved: an older version is approved and labelled, expired: the approved version rolled out of the history
+	parameters := map[string][]version{
+		"/c1/ns/Deployment/approved/app/resourceSpec":    {{Version: 3, Value: spec("300"), Labels: []string{"Approved"}}, {Version: 5, Value: spec("500")}},
+		"/c1/ns/Deployment/expired/app/resourceSpec":     {{Version: 150, Value: spec("150")}},
+		"/c1/ns/Deployment/notapproved/app/resourceSpec": {{Version: 1, Value: spec("100"), Labels: []string{"NotApproved"}}},
+	}
+	tags := map[string]map[string]string{
+		"/c1/ns/Deployment/approved/app/resourceSpec":    {"approval": "Approved", "approvedVersion": "3", "approvedBy": "ops", "approvedAt": "2026-01-02T00:00:00Z"},
+		"/c1/ns/Deployment/expired/app/resourceSpec":     {"approval": "Approved", "approvedVersion": "20", "approvedBy": "ops", "approvedAt": "2026-01-02T00:00:00Z"},
+		"/c1/ns/Deployment/notapproved/app/resourceSpec": {"approval": "NotApproved", "unapprovedBy": "ops", "unapprovedAt": "2026-01-02T00:00:00Z", "currentCpuLimit": "200", "currentMemLimit": "512", "currentCpuRequest": "200", "currentMemRequest": "256"},
+	}
+
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+		calls[operation]++
+		var input struct {
+			Name             string
+			ResourceId       string
+			ParameterFilters []struct{ Values []string }
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+
+		result := make(map[string]interface{})
+		switch operation {
+		case "GetParametersByPath":
+			var found []version
+			for name, versions := range parameters {
+				for i, val := range versions {
+					labelled := len(input.ParameterFilters) > 0 && len(val.Labels) > 0 && val.Labels[0] == input.ParameterFilters[0].Values[0]
+					if labelled || (len(input.ParameterFilters) == 0 && i == len(versions)-1) {
+						found = append(found, version{Name: name, Value: val.Value, Version: val.Version})
+					}
+				}
+			}
+			result["Parameters"] = found
+		case "ListTagsForResource":
+			var tagList []map[string]string
+			for key, val := range tags[input.ResourceId] {
+				tagList = append(tagList, map[string]string{"Key": key, "Value": val})
+			}
+			result["TagList"] = tagList
+		case "GetParameterHistory":
+			result["Parameters"] = parameters[input.Name]
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+
+	defer func(originalEndpoint string, originalTemplate string, originalCreds *awsCredentials) {
+		endpoint, keyTemplate, credentialCache = originalEndpoint, originalTemplate, originalCreds
+		parameterCache, prefetched = make(map[string]cachedParameter), make(map[string]error)
+		tagCache, historyCache = make(map[string]map[string]string), make(map[string][]parameterVersion)
+	}(endpoint, keyTemplate, credentialCache)
+	endpoint, keyTemplate, credentialCache = server.URL, defaultKeyTemplate, &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+
+	tests := []struct {
+		name     string
+		cpu      string
+		approval string
+		err      string
+	}{
+		{"approved", "300m", "Approved (version 3 by ops at 2026-01-02T00:00:00Z, version 5 awaiting approval)", ""},
+		{"expired", "", "Approved (version 20 by ops at 2026-01-02T00:00:00Z, version 150 awaiting approval - approved version 20 is no longer in the parameter history (parameter store keeps the last 100 versions) - approve the latest version again)", "approved version 20 is no longer in the parameter history"},
+		{"notapproved", "200m", "Not Approved (by ops at 2026-01-02T00:00:00Z)", ""},
+	}
+
+	for _, test := range tests {
+		insight, _, err := GetInsight("c1", "ns", "Deployment", test.name, "app")
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: GetInsight error = %v, want %s", test.name, err, test.err)
+			}
+		} else if err != nil || insight["limits"]["cpu"] != test.cpu {
+			t.Errorf("%s: GetInsight = %v (%v), want cpu %s", test.name, insight, err, test.cpu)
+		}
+		if approval, err := GetApprovalSetting("c1", "ns", "Deployment", test.name, "app"); err != nil || approval != test.approval {
+			t.Errorf("%s: GetApprovalSetting = %s (%v), want %s", test.name, approval, err, test.approval)
+		}
+	}
+
+	//one bulk fetch plus one per label, one tag lookup per parameter, and the history only for the expired approval
+	if calls["GetParametersByPath"] != 3 || calls["ListTagsForResource"] != 3 || calls["GetParameterHistory"] != 1 {
+		t.Errorf("calls = %v, want 3 GetParametersByPath, 3 ListTagsForResource and 1 GetParameterHistory", calls)
+	}
+
+}
+
+//TestUpdateApprovalSetting checks withdrawing an approval records who withdrew it, and removes the tags of the previous approval
+func TestUpdateApprovalSetting(t *testing.T) {
+
+	ssmKey := "/c1/ns/Deployment/web/app/resourceSpec"
+	tags := map[string]string{"approval": "Approved", "approvedVersion": "2", "approvedBy": "ops", "approvedAt": "2026-01-02T00:00:00Z"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Tags    []map[string]string
+			TagKeys []string
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+
+		result := make(map[string]interface{})
+		switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.") {
+		case "GetParametersByPath":
+			result["Parameters"] = []map[string]interface{}{{"Name": ssmKey, "Value": "{}", "Version": 2}}
+		case "AddTagsToResource":
+			for _, tag := range input.Tags {
+				tags[tag["Key"]] = tag["Value"]
+			}
+		case "RemoveTagsFromResource":
+			for _, key := range input.TagKeys {
+				delete(tags, key)
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+
+	defer func(originalEndpoint string, originalTemplate string, originalCreds *awsCredentials, originalCaller string) {
+		endpoint, keyTemplate, credentialCache, callerArn = originalEndpoint, originalTemplate, originalCreds, originalCaller
+		parameterCache, prefetched = make(map[string]cachedParameter), make(map[string]error)
+		tagCache, historyCache = make(map[string]map[string]string), make(map[string][]parameterVersion)
+	}(endpoint, keyTemplate, credentialCache, callerArn)
+	endpoint, keyTemplate, credentialCache, callerArn = server.URL, defaultKeyTemplate, &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, "arn:aws:iam::123456789012:user/dev"
+
+	if err := UpdateApprovalSetting(false, "c1", "ns", "Deployment", "web", "app"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"approvedVersion", "approvedBy", "approvedAt"} {
+		if _, ok := tags[key]; ok {
+			t.Errorf("tag %s kept after the approval was withdrawn: %v", key, tags)
+		}
+	}
+	if tags["approval"] != "NotApproved" || tags["unapprovedBy"] != "arn:aws:iam::123456789012:user/dev" || tags["unapprovedAt"] == "" {
+		t.Errorf("tags = %v, want approval NotApproved by arn:aws:iam::123456789012:user/dev", tags)
+	}
+
+	if err := UpdateApprovalSetting(true, "c1", "ns", "Deployment", "web", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tags["unapprovedBy"]; ok || tags["approval"] != "Approved" || tags["approvedVersion"] != "2" {
+		t.Errorf("tags = %v, want approval Approved of version 2 without unapprovedBy", tags)
+	}
+
+}
+
+//TestSyncParameter syncs recommendations into a fake parameter store, and checks only the changes are written
+func TestSyncParameter(t *testing.T) {
+
+	ssmKey := "/c1/ns/Deployment/web/app/resourceSpec"
+	recommended := map[string]map[string]string{"limits": {"cpu": "500m", "memory": "512Mi"}, "requests": {"cpu": "250m", "memory": "256Mi"}}
+	changed := map[string]map[string]string{"limits": {"cpu": "600m", "memory": "512Mi"}, "requests": {"cpu": "300m", "memory": "256Mi"}}
+	current := map[string]map[string]string{"limits": {"cpu": "1", "memory": "1Gi"}, "requests": {"cpu": "500m", "memory": "512Mi"}}
+	incomplete := map[string]map[string]string{"requests": {"cpu": "500m", "memory": "512Mi"}}
+
+	recommendedValue := `{"limits":{"cpu":"500","memory":"512"},"requests":{"cpu":"250","memory":"256"}}`
+	syncedTags := func() map[string]string {
+		return map[string]string{
+			"currentCpuLimit": "1000", "currentMemLimit": "1024", "currentCpuRequest": "500", "currentMemRequest": "512",
+			"recommendedCpuLimit": "500", "recommendedMemLimit": "512", "recommendedCpuRequest": "250", "recommendedMemRequest": "256",
+			"approval": "NotApproved", "unapprovedBy": "ops", "unapprovedAt": "2026-01-02T00:00:00Z",
+		}
+	}
+
+	tests := []struct {
+		name        string
+		existing    bool
+		current     map[string]map[string]string
+		recommended map[string]map[string]string
+		approved    bool
+		status      string
+		writes      []string
+		tags        map[string]string
+	}{
+		{"create", false, current, recommended, false, "created", []string{"PutParameter", "LabelParameterVersion"}, nil},
+		{"unchanged", true, current, recommended, false, "unchanged", nil, nil},
+		{"spec change", true, current, changed, false, "updated", []string{"PutParameter", "AddTagsToResource"},
+			map[string]string{"recommendedCpuLimit": "600", "recommendedCpuRequest": "300"}},
+		{"approval change", true, current, recommended, true, "updated", []string{"LabelParameterVersion", "AddTagsToResource", "RemoveTagsFromResource"},
+			map[string]string{"approval": "Approved", "approvedVersion": "1", "approvedBy": "arn:aws:iam::123456789012:user/dev", "unapprovedBy": ""}},
+		{"incomplete current spec", true, incomplete, recommended, false, "unchanged", nil, nil},
+	}
+
+	defer func(originalEndpoint string, originalTemplate string, originalCreds *awsCredentials, originalCaller string) {
+		endpoint, keyTemplate, credentialCache, callerArn = originalEndpoint, originalTemplate, originalCreds, originalCaller
+		parameterCache, prefetched = make(map[string]cachedParameter), make(map[string]error)
+		tagCache, historyCache = make(map[string]map[string]string), make(map[string][]parameterVersion)
+	}(endpoint, keyTemplate, credentialCache, callerArn)
+
+	for _, test := range tests {
+
+		var value string
+		var version int64
+		tags := make(map[string]string)
+		if test.existing {
+			value, version, tags = recommendedValue, 1, syncedTags()
+		}
+
+		var writes []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+			var input struct {
+				Value            string
+				Tags             []map[string]string
+				TagKeys          []string
+				ParameterFilters []interface{}
+			}
+			json.NewDecoder(r.Body).Decode(&input)
+
+			result := make(map[string]interface{})
+			switch operation {
+			case "GetParametersByPath":
+				if version > 0 && len(input.ParameterFilters) == 0 {
+					result["Parameters"] = []map[string]interface{}{{"Name": ssmKey, "Value": value, "Version": version}}
+				}
+			case "ListTagsForResource":
+				var tagList []map[string]string
+				for key, val := range tags {
+					tagList = append(tagList, map[string]string{"Key": key, "Value": val})
+				}
+				result["TagList"] = tagList
+			case "PutParameter":
+				writes = append(writes, operation)
+				value, version = input.Value, version+1
+				for _, tag := range input.Tags {
+					tags[tag["Key"]] = tag["Value"]
+				}
+				result["Version"] = version
+			case "AddTagsToResource":
+				writes = append(writes, operation)
+				for _, tag := range input.Tags {
+					tags[tag["Key"]] = tag["Value"]
+				}
+			case "RemoveTagsFromResource":
+				writes = append(writes, operation)
+				for _, key := range input.TagKeys {
+					delete(tags, key)
+				}
+			default:
+				writes = append(writes, operation)
+			}
+			json.NewEncoder(w).Encode(result)
+		}))
+
+		endpoint, keyTemplate, callerArn = server.URL, defaultKeyTemplate, "arn:aws:iam::123456789012:user/dev"
+		credentialCache = &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+		parameterCache, prefetched = make(map[string]cachedParameter), make(map[string]error)
+		tagCache, historyCache = make(map[string]map[string]string), make(map[string][]parameterVersion)
+
+		status, err := SyncParameter("c1", "ns", "Deployment", "web", "app", test.current, test.recommended, test.approved)
+		server.Close()
+
+		if err != nil || status != test.status || !reflect.DeepEqual(writes, test.writes) {
+			t.Errorf("%s: SyncParameter = %s (%v) with writes %v, want %s with writes %v", test.name, status, err, writes, test.status, test.writes)
+		}
+		for key, val := range test.tags {
+			if tags[key] != val {
+				t.Errorf("%s: tag %s = [%s], want [%s]", test.name, key, tags[key], val)
+			}
+		}
+		if test.name == "create" && (tags["currentCpuLimit"] != "1000" || tags["approval"] != "NotApproved" || value != recommendedValue) {
+			t.Errorf("%s: parameter = %s with tags %v, want %s with the current spec and NotApproved", test.name, value, tags, recommendedValue)
+		}
+
+	}
+
+}
@@ -0,0 +1,483 @@
+package support
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ghodss/yaml"
+)
+
+//ConfigKeys holds the configuration keys of the plugin.  Each key can be overridden with a HELM_OPTIMIZE_<KEY> environment variable (eg. HELM_OPTIMIZE_REMOTE_CLUSTER).
+var ConfigKeys = []string{
+	"adapter", "remoteCluster", "lookupMappings", "workloadAlias",
+	"densifyURL", "densifyUser", "densifyPass", "densifyAPIKey", "densifyToken", "densifyTokenExpiry", "densifyCredentialSource",
+	"densifyAnalysis", "densifyNamespaceAnalyses", "densifyDisambiguation", "densifyDeployAttribute",
+	"prefix", "keyTemplate", "endpoint", "profile", "region", "roleArn", "externalId", "roleSessionName",
+}
+
+//ConfigFile holds the path of the local config file, ConfigStore where the configuration is written (file or secret)
+var (
+	ConfigFile  string
+	ConfigStore string
+)
+
+//configOverrides holds the configuration set by command line flags
+var configOverrides = make(map[string]string)
+
+//ActiveProfile holds the named profile the configuration is read from and written to ("" being the default profile).
+//The keys of a named profile are stored as profile.<name>.<key> alongside the keys of the default profile.
+var ActiveProfile string
+
+//profileContextsKey holds the mapping of kube-contexts to profiles (eg. {"prod-eks":"prod"}), shared by all profiles
+const profileContextsKey = "profileContexts"
+
+var profilePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+//InitConfig resolves the local config file and the config store.  The file defaults to $HELM_CONFIG_HOME/optimize/config.yaml,
+//and the store defaults to the file if it exists, otherwise the cluster secret.
+func InitConfig(file string, store string) error {
+
+	if ConfigFile = file; ConfigFile == "" {
+		if ConfigFile = os.Getenv("HELM_OPTIMIZE_CONFIG"); ConfigFile == "" && os.Getenv("HELM_CONFIG_HOME") != "" {
+			ConfigFile = filepath.Join(os.Getenv("HELM_CONFIG_HOME"), "optimize", "config.yaml")
+		}
+	}
+
+	if ConfigStore = store; ConfigStore == "" {
+		if ConfigStore = os.Getenv("HELM_OPTIMIZE_CONFIG_STORE"); ConfigStore == "" {
+			ConfigStore = "secret"
+			if ConfigFile != "" && FileExists(ConfigFile) {
+				ConfigStore = "file"
+			}
+		}
+	}
+
+	if ConfigStore != "file" && ConfigStore != "secret" {
+		return errors.New("config store must be one of [file, secret]")
+	}
+
+	if ConfigStore == "file" && ConfigFile == "" {
+		return errors.New("config store [file] requires a config file - set HELM_CONFIG_HOME or --config")
+	}
+
+	return nil
+
+}
+
+//SelectProfile selects the profile the configuration is read from and written to.  The profile defaults to $HELM_OPTIMIZE_PROFILE,
+//then the profile mapped to the kube-context, otherwise the default profile.
+func SelectProfile(name string, kubeContext string, secretName string) error {
+
+	if name == "" {
+		name = os.Getenv("HELM_OPTIMIZE_PROFILE")
+	}
+	if name == "" {
+		name = ProfileContexts(secretName)[kubeContext]
+	}
+	if name == "default" {
+		name = ""
+	}
+
+	if name != "" && !profilePattern.MatchString(name) {
+		return errors.New("invalid profile name [" + name + "] - use letters, digits, '-' and '_'")
+	}
+	ActiveProfile = name
+
+	return nil
+
+}
+
+//ProfileName returns the name of the active profile.
+func ProfileName() string {
+
+	if ActiveProfile == "" {
+		return "default"
+	}
+
+	return ActiveProfile
+
+}
+
+//ListProfiles returns the default profile followed by the named profiles in alphabetical order.
+func ListProfiles(secretName string) []string {
+
+	var profiles []string
+	for key := range storedConfig(secretName) {
+		if !strings.HasPrefix(key, "profile.") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(key, "profile."), ".", 2)[0]
+		if _, ok := InSlice(profiles, name); !ok {
+			profiles = append(profiles, name)
+		}
+	}
+	sort.Strings(profiles)
+
+	return append([]string{"default"}, profiles...)
+
+}
+
+//ProfileExists checks whether a named profile holds any keys in the config store, the default profile always exists.
+func ProfileExists(secretName string, name string) bool {
+
+	if name == "" || name == "default" {
+		return true
+	}
+	_, ok := InSlice(ListProfiles(secretName), name)
+
+	return ok
+
+}
+
+//ProfileContexts returns the mapping of kube-contexts to profiles.
+func ProfileContexts(secretName string) map[string]string {
+
+	contexts := make(map[string]string)
+	if val, ok := storedConfig(secretName)[profileContextsKey]; ok {
+		json.Unmarshal([]byte(val), &contexts)
+	}
+
+	return contexts
+
+}
+
+//SetProfileContext maps the kube-context to the profile, the default profile removes the mapping.
+func SetProfileContext(secretName string, kubeContext string, name string) error {
+
+	contexts := ProfileContexts(secretName)
+	if name == "" || name == "default" {
+		delete(contexts, kubeContext)
+	} else {
+		contexts[kubeContext] = name
+	}
+
+	if len(contexts) == 0 {
+		return updateStore(secretName, nil, []string{profileContextsKey})
+	}
+
+	mapping, err := json.Marshal(contexts)
+	if err != nil {
+		return err
+	}
+
+	return updateStore(secretName, map[string]string{profileContextsKey: string(mapping)}, nil)
+
+}
+
+//DeleteProfile removes the keys of a named profile from the config store, along with the kube-contexts mapped to it.
+func DeleteProfile(secretName string, name string) error {
+
+	if name == "" || name == "default" {
+		return errors.New("the default profile cannot be deleted - use 'helm optimize -c --clear-config' to erase it")
+	}
+
+	values, err := readStore(secretName)
+	if err != nil {
+		return err
+	}
+
+	//the keys are read from the config store, as are the profiles listed by ListProfiles
+	var keys []string
+	for key := range values {
+		if strings.HasPrefix(key, "profile."+name+".") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("profile [" + name + "] does not exist in the config store")
+	}
+
+	contexts := ProfileContexts(secretName)
+	for kubeContext, profile := range contexts {
+		if profile == name {
+			delete(contexts, kubeContext)
+		}
+	}
+	if len(contexts) == 0 {
+		keys = append(keys, profileContextsKey)
+		return updateStore(secretName, nil, keys)
+	}
+
+	mapping, err := json.Marshal(contexts)
+	if err != nil {
+		return err
+	}
+
+	return updateStore(secretName, map[string]string{profileContextsKey: string(mapping)}, keys)
+
+}
+
+//SetConfigOverride overrides a configuration value, taking precedence over every other source.
+func SetConfigOverride(key string, value string) {
+	configOverrides[key] = value
+}
+
+//overridden checks whether a configuration key is resolved from a flag or environment variable override (see ResolveConfig),
+//whatever value is being stored for it.
+func overridden(key string) bool {
+
+	if _, ok := configOverrides[key]; ok {
+		return true
+	}
+
+	if _, ok := InSlice(ConfigKeys, key); ok {
+		_, set := os.LookupEnv(ConfigEnvVar(key))
+		return set
+	}
+
+	return false
+
+}
+
+//ConfigEnvVar returns the environment variable that overrides a configuration key (eg. densifyAPIKey -> HELM_OPTIMIZE_DENSIFY_API_KEY).
+func ConfigEnvVar(key string) string {
+
+	runes := []rune(key)
+	var name strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+
+	return "HELM_OPTIMIZE_" + name.String()
+
+}
+
+//ResolveConfig returns the effective configuration of the active profile along with the source of each value.
+//Sources take precedence in the following order: flag, env, file, secret.  The secret is not read when the config store is the file.
+func ResolveConfig(secretName string) (map[string]string, map[string]string) {
+
+	values := make(map[string]string)
+	sources := make(map[string]string)
+
+	if ConfigStore != "file" {
+		for key, val := range scopeProfile(readSecret(secretName)) {
+			values[key], sources[key] = val, "secret"
+		}
+	}
+
+	if fileValues, err := readConfigFile(); err == nil {
+		for key, val := range scopeProfile(fileValues) {
+			values[key], sources[key] = val, "file"
+		}
+	}
+
+	for _, key := range ConfigKeys {
+		if val, ok := os.LookupEnv(ConfigEnvVar(key)); ok {
+			values[key], sources[key] = val, "env"
+		}
+	}
+
+	for key, val := range configOverrides {
+		values[key], sources[key] = val, "flag"
+	}
+
+	return values, sources
+
+}
+
+//SortedConfigKeys returns the keys of a configuration in the order of ConfigKeys, followed by unknown keys in alphabetical order.
+func SortedConfigKeys(values map[string]string) []string {
+
+	var keys, unknown []string
+	for _, key := range ConfigKeys {
+		if _, ok := values[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range values {
+		if _, ok := InSlice(ConfigKeys, key); !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	return append(keys, unknown...)
+
+}
+
+//ClearConfig erases the configuration of the active profile held in the config store.
+func ClearConfig(secretName string) error {
+
+	if ConfigStore == "secret" {
+		LocateConfigNamespace(secretName)
+	}
+
+	values, err := readStore(secretName)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range values {
+		if inProfile(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return updateStore(secretName, nil, keys)
+
+}
+
+//scopedKey returns the key under which a configuration key of the active profile is stored.
+func scopedKey(key string) string {
+
+	if ActiveProfile == "" {
+		return key
+	}
+
+	return "profile." + ActiveProfile + "." + key
+
+}
+
+//inProfile checks whether a stored key belongs to the active profile.
+func inProfile(key string) bool {
+
+	if ActiveProfile != "" {
+		return strings.HasPrefix(key, "profile."+ActiveProfile+".")
+	}
+
+	return !strings.HasPrefix(key, "profile.") && key != profileContextsKey
+
+}
+
+//scopeProfile returns the keys of the active profile from the stored keys.
+func scopeProfile(values map[string]string) map[string]string {
+
+	scoped := make(map[string]string)
+	for key, val := range values {
+		if inProfile(key) {
+			scoped[strings.TrimPrefix(key, "profile."+ActiveProfile+".")] = val
+		}
+	}
+
+	return scoped
+
+}
+
+//storedConfig returns the keys of every profile held in the config store, the same keys the profiles are updated and deleted from.
+func storedConfig(secretName string) map[string]string {
+
+	values, err := readStore(secretName)
+	if err != nil {
+		return make(map[string]string)
+	}
+
+	return values
+
+}
+
+func readStore(secretName string) (map[string]string, error) {
+
+	values, _, err := readStoreVersion(secretName)
+	return values, err
+
+}
+
+//readStoreVersion reads the config store along with the resourceVersion of the secret ("" for the local config file or a missing secret)
+func readStoreVersion(secretName string) (map[string]string, string, error) {
+
+	if ConfigStore == "file" {
+		values, err := readConfigFile()
+		return values, "", err
+	}
+
+	values, resourceVersion, err := readSecretVersion(secretName)
+	if err != nil {
+		return nil, "", err
+	}
+	if values == nil {
+		values = make(map[string]string)
+	}
+
+	return values, resourceVersion, nil
+
+}
+
+//updateStore sets and removes stored keys in the config store.  The store is only written when its content changes,
+//and is deleted once it holds no keys.  The secret is only written if it is unchanged since it was read.
+func updateStore(secretName string, set map[string]string, remove []string) error {
+
+	values, resourceVersion, err := readStoreVersion(secretName)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for key, val := range set {
+		if current, ok := values[key]; !ok || current != val {
+			values[key], changed = val, true
+		}
+	}
+	for _, key := range remove {
+		if _, ok := values[key]; ok {
+			delete(values, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if ConfigStore == "file" {
+		if len(values) == 0 {
+			return os.Remove(ConfigFile)
+		}
+		return writeConfigFile(values)
+	}
+
+	if len(values) == 0 {
+		DeleteSecret(secretName)
+		return nil
+	}
+
+	return writeSecret(secretName, values, resourceVersion)
+
+}
+
+func readConfigFile() (map[string]string, error) {
+
+	values := make(map[string]string)
+	if ConfigFile == "" {
+		return values, nil
+	}
+
+	content, err := ioutil.ReadFile(ConfigFile)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, errors.New("'" + ConfigFile + "' not a valid config file")
+	}
+
+	return values, nil
+
+}
+
+func writeConfigFile(values map[string]string) error {
+
+	content, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ConfigFile), 0700); err != nil {
+		return err
+	}
+
+	//the config file holds credentials, so it is only readable by the user
+	return ioutil.WriteFile(ConfigFile, content, 0600)
+
+}
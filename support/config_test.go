@@ -0,0 +1,193 @@
+package support
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//useConfigFile points the config store to a config file in a temporary directory, and the secret to a missing kubectl
+func useConfigFile(t *testing.T, content string) func() {
+
+	dir, err := ioutil.TempDir("", "helm-optimize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.yaml")
+	if content != "" {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	originalFile, originalStore, originalKubectl, originalProfile := ConfigFile, ConfigStore, KubectlBin, ActiveProfile
+	ConfigFile, ConfigStore, KubectlBin, ActiveProfile = file, "file", filepath.Join(dir, "kubectl"), ""
+
+	return func() {
+		ConfigFile, ConfigStore, KubectlBin, ActiveProfile = originalFile, originalStore, originalKubectl, originalProfile
+		configOverrides = make(map[string]string)
+		os.RemoveAll(dir)
+	}
+
+}
+
+//setEnv sets an environment variable until the returned function restores it
+func setEnv(name string, value string) func() {
+
+	original, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+
+	return func() {
+		if ok {
+			os.Setenv(name, original)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+
+}
+
+func TestResolveConfig(t *testing.T) {
+
+	defer useConfigFile(t, "adapter: Densify\nremoteCluster: file-cluster\nregion: file-region\nprefix: file-prefix\nprofile.prod.region: prod-region\n")()
+	defer setEnv("HELM_OPTIMIZE_REGION", "env-region")()
+	defer setEnv("HELM_OPTIMIZE_PREFIX", "env-prefix")()
+	SetConfigOverride("prefix", "flag-prefix")
+
+	tests := []struct {
+		profile string
+		values  map[string]string
+		sources map[string]string
+	}{
+		{"", map[string]string{"adapter": "Densify", "remoteCluster": "file-cluster", "region": "env-region", "prefix": "flag-prefix"},
+			map[string]string{"adapter": "file", "remoteCluster": "file", "region": "env", "prefix": "flag"}},
+		{"prod", map[string]string{"region": "env-region", "prefix": "flag-prefix"},
+			map[string]string{"region": "env", "prefix": "flag"}},
+	}
+
+	for _, test := range tests {
+		ActiveProfile = test.profile
+		values, sources := ResolveConfig("helm-optimize-plugin")
+		if !reflect.DeepEqual(values, test.values) || !reflect.DeepEqual(sources, test.sources) {
+			t.Errorf("profile [%s]: ResolveConfig = %v %v, want %v %v", test.profile, values, sources, test.values, test.sources)
+		}
+	}
+
+}
+
+//TestResolveConfigSecret checks the secret is only read when it is the config store
+func TestResolveConfigSecret(t *testing.T) {
+
+	defer useConfigFile(t, "adapter: Densify\n")()
+
+	//densifyURL: https://densify
+	calls := filepath.Join(filepath.Dir(ConfigFile), "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\necho '{\"metadata\":{\"resourceVersion\":\"1\"},\"data\":{\"densifyURL\":\"aHR0cHM6Ly9kZW5zaWZ5\"}}'\n"
+	if err := ioutil.WriteFile(KubectlBin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if values, _ := ResolveConfig("helm-optimize-plugin"); values["densifyURL"] != "" || FileExists(calls) {
+		t.Errorf("file store: ResolveConfig = %v, want the secret not to be read", values)
+	}
+
+	ConfigStore = "secret"
+	if values, sources := ResolveConfig("helm-optimize-plugin"); values["densifyURL"] != "https://densify" || sources["densifyURL"] != "secret" || values["adapter"] != "Densify" {
+		t.Errorf("secret store: ResolveConfig = %v %v, want densifyURL from the secret and adapter from the file", values, sources)
+	}
+
+}
+
+func TestStoreSecretsSkipsOverrides(t *testing.T) {
+
+	defer useConfigFile(t, "densifyAPIKey: stored-key\n")()
+	defer setEnv("HELM_OPTIMIZE_DENSIFY_API_KEY", "env-key")()
+	SetConfigOverride("remoteCluster", "flag-cluster")
+
+	//the keys resolved from the overrides are written back (even with a renewed value), along with values entered by the user
+	StoreSecrets("helm-optimize-plugin", map[string]string{"densifyAPIKey": "renewed-key", "remoteCluster": "flag-cluster", "densifyURL": "https://densify"})
+
+	stored, err := readConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"densifyAPIKey": "stored-key", "densifyURL": "https://densify"}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored config = %v, want %v", stored, want)
+	}
+
+}
+
+func TestProfiles(t *testing.T) {
+
+	defer useConfigFile(t, "adapter: Densify\nprofile.prod.adapter: Parameter Store\nprofile.prod.region: us-east-1\nprofile.dev.adapter: Densify\n")()
+
+	if err := SetProfileContext("helm-optimize-plugin", "prod-eks", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetProfileContext("helm-optimize-plugin", "dev-kind", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if contexts := ProfileContexts("helm-optimize-plugin"); !reflect.DeepEqual(contexts, map[string]string{"prod-eks": "prod", "dev-kind": "dev"}) {
+		t.Errorf("ProfileContexts = %v, want prod-eks and dev-kind mapped", contexts)
+	}
+
+	tests := []struct {
+		name    string
+		env     string
+		context string
+		profile string
+		err     bool
+	}{
+		{"", "", "prod-eks", "prod", false},
+		{"", "", "other", "", false},
+		{"", "dev", "prod-eks", "dev", false},
+		{"dev", "prod", "prod-eks", "dev", false},
+		{"default", "", "prod-eks", "", false},
+		{"bad name", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		restore := setEnv("HELM_OPTIMIZE_PROFILE", test.env)
+		if test.env == "" {
+			os.Unsetenv("HELM_OPTIMIZE_PROFILE")
+		}
+		ActiveProfile = ""
+		err := SelectProfile(test.name, test.context, "helm-optimize-plugin")
+		restore()
+		if (err != nil) != test.err || ActiveProfile != test.profile {
+			t.Errorf("SelectProfile(%s) with env [%s] in context [%s] = [%s] (%v), want [%s]", test.name, test.env, test.context, ActiveProfile, err, test.profile)
+		}
+	}
+
+	//mapping a context to the default profile removes the mapping
+	if err := SetProfileContext("helm-optimize-plugin", "dev-kind", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if contexts := ProfileContexts("helm-optimize-plugin"); !reflect.DeepEqual(contexts, map[string]string{"prod-eks": "prod"}) {
+		t.Errorf("ProfileContexts = %v, want only prod-eks mapped", contexts)
+	}
+
+	if err := DeleteProfile("helm-optimize-plugin", "default"); err == nil {
+		t.Errorf("DeleteProfile(default) succeeded, want an error")
+	}
+	if err := DeleteProfile("helm-optimize-plugin", "staging"); err == nil {
+		t.Errorf("DeleteProfile(staging) succeeded, want an error")
+	}
+	if err := DeleteProfile("helm-optimize-plugin", "prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := readConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"adapter": "Densify", "profile.dev.adapter": "Densify"}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored config = %v, want %v", stored, want)
+	}
+	if profiles := ListProfiles("helm-optimize-plugin"); !reflect.DeepEqual(profiles, []string{"default", "dev"}) || ProfileExists("helm-optimize-plugin", "prod") {
+		t.Errorf("ListProfiles = %v, want [default dev]", profiles)
+	}
+
+}
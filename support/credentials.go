@@ -0,0 +1,79 @@
+package support
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//Credential holds the credential returned by a credential source.  An empty username means the secret is an api key.
+type Credential struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+//ValidateCredentialSource checks the format of a credential source (helper:<command>, env:<VAR> or file:<path>).
+func ValidateCredentialSource(source string) error {
+
+	pair := strings.SplitN(source, ":", 2)
+	if len(pair) != 2 || strings.TrimSpace(pair[1]) == "" {
+		return errors.New("invalid credential source [" + source + "] - expected helper:<command>, env:<VAR> or file:<path>")
+	}
+
+	if _, ok := InSlice([]string{"helper", "env", "file"}, pair[0]); !ok {
+		return errors.New("invalid credential source [" + source + "] - expected helper:<command>, env:<VAR> or file:<path>")
+	}
+
+	return nil
+
+}
+
+//ResolveCredential resolves a credential from its source.  A credential helper is called like a docker credential helper,
+//'<command> get' with the server url on stdin, and prints {"Username": "...", "Secret": "..."} (or only the secret).
+//The helper command is split on whitespace into the command and its arguments, without shell quoting, so the path of the
+//helper can't contain spaces (use a wrapper script on the PATH instead).  Environment variables and files hold the secret itself.
+func ResolveCredential(source string, serverURL string) (Credential, error) {
+
+	if err := ValidateCredentialSource(source); err != nil {
+		return Credential{}, err
+	}
+	pair := strings.SplitN(source, ":", 2)
+
+	switch pair[0] {
+	case "env":
+		if val := os.Getenv(pair[1]); val != "" {
+			return Credential{Secret: val}, nil
+		}
+		return Credential{}, errors.New("credential environment variable [" + pair[1] + "] is not set")
+	case "file":
+		content, err := ioutil.ReadFile(pair[1])
+		if err != nil {
+			return Credential{}, errors.New("unable to read credential file [" + pair[1] + "]")
+		}
+		if secret := strings.TrimSpace(string(content)); secret != "" {
+			return Credential{Secret: secret}, nil
+		}
+		return Credential{}, errors.New("credential file [" + pair[1] + "] is empty")
+	}
+
+	//the helper is executed directly (not through a shell), so its output never passes through the process arguments
+	stdOut, stdErr, err := ExecuteCommandWithStdin(append(strings.Fields(pair[1]), "get"), []byte(serverURL))
+	if err != nil {
+		return Credential{}, errors.New("credential helper [" + pair[1] + "] failed: " + strings.TrimSpace(stdErr))
+	}
+
+	//only an object is parsed, any other output (eg. a secret that happens to be valid json, like null or a number) is the secret itself
+	output := strings.TrimSpace(stdOut)
+	var credential Credential
+	if !strings.HasPrefix(output, "{") || json.Unmarshal([]byte(output), &credential) != nil {
+		credential = Credential{Secret: output}
+	}
+	if credential.Secret == "" {
+		return Credential{}, errors.New("credential helper [" + pair[1] + "] returned no secret")
+	}
+
+	return credential, nil
+
+}
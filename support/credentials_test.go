@@ -0,0 +1,63 @@
+package support
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveCredential(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "helm-optimize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//the helpers echo the server url they receive on stdin, and the arguments they were called with
+	helpers := map[string]string{
+		"json":   "#!/bin/sh\nread url\necho \"{\\\"Username\\\": \\\"$url\\\", \\\"Secret\\\": \\\"$*\\\"}\"\n",
+		"plain":  "#!/bin/sh\necho '  secret  '\n",
+		"null":   "#!/bin/sh\necho null\n",
+		"number": "#!/bin/sh\necho 12345\n",
+		"empty":  "#!/bin/sh\necho '{\"Username\": \"user\"}'\n",
+		"failed": "#!/bin/sh\necho denied >&2\nexit 1\n",
+	}
+	for name, script := range helpers {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("file-secret\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "blank"), []byte("\n"), 0600)
+	defer setEnv("HELM_OPTIMIZE_TEST_SECRET", "env-secret")()
+
+	tests := []struct {
+		source     string
+		credential Credential
+		err        bool
+	}{
+		{"env:HELM_OPTIMIZE_TEST_SECRET", Credential{Secret: "env-secret"}, false},
+		{"env:HELM_OPTIMIZE_TEST_MISSING", Credential{}, true},
+		{"file:" + filepath.Join(dir, "secret"), Credential{Secret: "file-secret"}, false},
+		{"file:" + filepath.Join(dir, "blank"), Credential{}, true},
+		{"file:" + filepath.Join(dir, "missing"), Credential{}, true},
+		{"helper:" + filepath.Join(dir, "json") + " --profile prod", Credential{Username: "https://densify", Secret: "--profile prod get"}, false},
+		{"helper:" + filepath.Join(dir, "plain"), Credential{Secret: "secret"}, false},
+		{"helper:" + filepath.Join(dir, "null"), Credential{Secret: "null"}, false},
+		{"helper:" + filepath.Join(dir, "number"), Credential{Secret: "12345"}, false},
+		{"helper:" + filepath.Join(dir, "empty"), Credential{}, true},
+		{"helper:" + filepath.Join(dir, "failed"), Credential{}, true},
+		{"vault:secret/densify", Credential{}, true},
+		{"env:", Credential{}, true},
+	}
+
+	for _, test := range tests {
+		credential, err := ResolveCredential(test.source, "https://densify")
+		if (err != nil) != test.err || credential != test.credential {
+			t.Errorf("ResolveCredential(%s) = %+v (%v), want %+v, error %v", test.source, credential, err, test.credential, test.err)
+		}
+	}
+
+}
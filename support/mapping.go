@@ -0,0 +1,89 @@
+package support
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+//LookupRule maps the local cluster, namespace and workload name of a lookup to the remote cluster, namespace and workload name
+type LookupRule struct {
+	Local  [3]string
+	Remote [3]string
+}
+
+//ParseLookupRules parses comma separated rules of the form <cluster>/<namespace>/<name>=<cluster>/<namespace>/<name>.
+//The local parts are glob patterns, and a remote part of '*' keeps the value being looked up.  A '*' within a remote part
+//(eg. staging-*=prod-*) is replaced by the text matched by the '*' of the local part, which must then hold a single '*'.
+func ParseLookupRules(list string) ([]LookupRule, error) {
+
+	var rules []LookupRule
+	for _, rule := range strings.Split(list, ",") {
+
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+
+		pair := strings.SplitN(rule, "=", 2)
+		if len(pair) != 2 {
+			return nil, errors.New("invalid mapping rule [" + rule + "] - expected <cluster>/<namespace>/<name>=<cluster>/<namespace>/<name>")
+		}
+		local, remote := strings.Split(pair[0], "/"), strings.Split(pair[1], "/")
+		if len(local) != 3 || len(remote) != 3 {
+			return nil, errors.New("invalid mapping rule [" + rule + "] - expected <cluster>/<namespace>/<name>=<cluster>/<namespace>/<name>")
+		}
+
+		var parsed LookupRule
+		for i := 0; i < 3; i++ {
+			if _, err := path.Match(local[i], ""); err != nil || local[i] == "" {
+				return nil, errors.New("invalid mapping rule [" + rule + "] - invalid pattern [" + local[i] + "]")
+			}
+			if remote[i] == "" {
+				return nil, errors.New("invalid mapping rule [" + rule + "] - empty remote value")
+			}
+			if remote[i] != "*" && strings.Contains(remote[i], "*") {
+				if strings.Count(remote[i], "*") != 1 || strings.Count(local[i], "*") != 1 || strings.ContainsAny(local[i], "?[\\") {
+					return nil, errors.New("invalid mapping rule [" + rule + "] - a remote value with '*' requires a local pattern with a single '*' and no other wildcards")
+				}
+			}
+			parsed.Local[i], parsed.Remote[i] = local[i], remote[i]
+		}
+		rules = append(rules, parsed)
+
+	}
+
+	return rules, nil
+
+}
+
+//Map applies the rule to a lookup of the workload in the local cluster, and reports whether the rule matched.
+func (r LookupRule) Map(localCluster string, remoteCluster string, namespace string, name string) (string, string, string, bool) {
+
+	for i, val := range []string{localCluster, namespace, name} {
+		if matched, _ := path.Match(r.Local[i], val); !matched {
+			return remoteCluster, namespace, name, false
+		}
+	}
+
+	mapped := []string{remoteCluster, namespace, name}
+	for i, val := range []string{localCluster, namespace, name} {
+		switch {
+		case r.Remote[i] == "*":
+		case strings.Contains(r.Remote[i], "*"):
+			//the local pattern is <prefix>*<suffix>, so the text matched by '*' is what remains of the value
+			affixes := strings.SplitN(r.Local[i], "*", 2)
+			matched := val[len(affixes[0]) : len(val)-len(affixes[1])]
+			mapped[i] = strings.Replace(r.Remote[i], "*", matched, 1)
+		default:
+			mapped[i] = r.Remote[i]
+		}
+	}
+
+	return mapped[0], mapped[1], mapped[2], true
+
+}
+
+//String returns the rule as <cluster>/<namespace>/<name> -> <cluster>/<namespace>/<name>
+func (r LookupRule) String() string {
+	return strings.Join(r.Local[:], "/") + " -> " + strings.Join(r.Remote[:], "/")
+}
@@ -0,0 +1,63 @@
+package support
+
+import "testing"
+
+func TestParseLookupRules(t *testing.T) {
+
+	tests := []struct {
+		list  string
+		rules int
+		err   bool
+	}{
+		{"", 0, false},
+		{"staging/staging/*=prod/prod/*", 1, false},
+		{"staging/staging/*=prod/prod/*, */staging-*/*=prod/prod-*/*", 2, false},
+		{"staging/staging=prod/prod", 0, true},
+		{"staging/staging/*", 0, true},
+		{"staging/[/*=prod/prod/*", 0, true},
+		{"staging//*=prod/prod/*", 0, true},
+		{"staging/staging/*=prod//*", 0, true},
+		{"*/staging/*=*/prod-*/*", 0, true},
+		{"*/staging-*-*/*=*/prod-*/*", 0, true},
+		{"*/staging-?*/*=*/prod-*/*", 0, true},
+	}
+
+	for _, test := range tests {
+		rules, err := ParseLookupRules(test.list)
+		if (err != nil) != test.err || len(rules) != test.rules {
+			t.Errorf("ParseLookupRules(%q) = %d rules (%v), want %d rules, error %v", test.list, len(rules), err, test.rules, test.err)
+		}
+	}
+
+}
+
+func TestLookupRuleMap(t *testing.T) {
+
+	tests := []struct {
+		rule      string
+		cluster   string
+		namespace string
+		name      string
+		mapped    string
+		matched   bool
+	}{
+		{"staging/staging/*=prod/prod/*", "staging", "staging", "web", "prod/prod/web", true},
+		{"staging/staging/*=prod/prod/*", "staging", "dev", "web", "remote/dev/web", false},
+		{"*/staging/web-*=*/prod/*", "staging", "staging", "web-1", "remote/prod/web-1", true},
+		{"*/staging-*/*=prod/prod-*/*", "staging", "staging-payments", "web", "prod/prod-payments/web", true},
+		{"staging-*/*/*=prod-*/*/*", "staging-eu", "ns", "web", "prod-eu/ns/web", true},
+		{"*/*/*-canary=*/*/*-stable", "staging", "ns", "web-canary", "remote/ns/web-stable", true},
+	}
+
+	for _, test := range tests {
+		rules, err := ParseLookupRules(test.rule)
+		if err != nil {
+			t.Fatalf("ParseLookupRules(%q) returned error: %v", test.rule, err)
+		}
+		cluster, namespace, name, matched := rules[0].Map(test.cluster, "remote", test.namespace, test.name)
+		if mapped := cluster + "/" + namespace + "/" + name; mapped != test.mapped || matched != test.matched {
+			t.Errorf("%s: Map(%s/%s/%s) = %s %v, want %s %v", test.rule, test.cluster, test.namespace, test.name, mapped, matched, test.mapped, test.matched)
+		}
+	}
+
+}
@@ -0,0 +1,110 @@
+package support
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var quantitySuffixes = map[string]float64{
+	"m":  1e-3,
+	"":   1,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"E":  1e18,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+	"Ei": 1 << 60,
+}
+
+//ParseQuantity converts a k8s resource quantity (eg. 250m, 1.5, 512Mi, 1G) into base units (cores or bytes).
+func ParseQuantity(quantity string) (float64, error) {
+
+	quantity = strings.TrimSpace(quantity)
+	if quantity == "" {
+		return 0, errors.New("empty quantity")
+	}
+
+	//split numeric portion from suffix
+	i := len(quantity)
+	for i > 0 && !(quantity[i-1] >= '0' && quantity[i-1] <= '9') && quantity[i-1] != '.' {
+		i--
+	}
+	number, suffix := quantity[:i], quantity[i:]
+
+	multiplier, ok := quantitySuffixes[suffix]
+	if !ok {
+		return 0, errors.New("invalid quantity suffix [" + suffix + "]")
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, errors.New("invalid quantity [" + quantity + "]")
+	}
+
+	return value * multiplier, nil
+
+}
+
+//FormatCPU converts cores into a millicore quantity string.  Floating point error is rounded away before rounding up (eg. 0.1 cores is 100m, not 101m).
+func FormatCPU(cores float64) string {
+	millicores := math.Round(cores*1000*1e6) / 1e6
+	return strconv.FormatFloat(math.Ceil(millicores), 'f', -1, 64) + "m"
+}
+
+//FormatMemory converts bytes into a Mi quantity string if it divides evenly, otherwise plain bytes.
+func FormatMemory(bytes float64) string {
+	bytes = math.Ceil(bytes)
+	if math.Mod(bytes, 1<<20) == 0 {
+		return strconv.FormatFloat(bytes/(1<<20), 'f', -1, 64) + "Mi"
+	}
+	return strconv.FormatFloat(bytes, 'f', -1, 64)
+}
+
+//FormatQuantity formats a value in base units for the given resource (cpu or memory).
+func FormatQuantity(resource string, value float64) string {
+	if resource == "cpu" {
+		return FormatCPU(value)
+	}
+	return FormatMemory(value)
+}
+
+//ResourceMap normalizes a resources block (as unmarshaled from yaml or produced by an adapter) into a nested string map.
+func ResourceMap(resources interface{}) map[string]map[string]string {
+
+	resourceMap := make(map[string]map[string]string)
+
+	switch val := resources.(type) {
+	case map[string]map[string]string:
+		for field, quantities := range val {
+			resourceMap[field] = make(map[string]string)
+			for resource, quantity := range quantities {
+				resourceMap[field][resource] = quantity
+			}
+		}
+	case map[string]interface{}:
+		for field, quantities := range val {
+			if quantityMap, ok := quantities.(map[string]interface{}); ok {
+				resourceMap[field] = make(map[string]string)
+				for resource, quantity := range quantityMap {
+					switch q := quantity.(type) {
+					case string:
+						resourceMap[field][resource] = q
+					case float64:
+						resourceMap[field][resource] = strconv.FormatFloat(q, 'f', -1, 64)
+					}
+				}
+			}
+		}
+	}
+
+	return resourceMap
+
+}
@@ -0,0 +1,62 @@
+package support
+
+import "testing"
+
+func TestParseQuantity(t *testing.T) {
+
+	tests := []struct {
+		quantity string
+		value    float64
+	}{
+		{"250m", 0.25},
+		{"1.5", 1.5},
+		{"2", 2},
+		{"1k", 1000},
+		{"1G", 1e9},
+		{"512Mi", 512 * (1 << 20)},
+		{"1Gi", 1 << 30},
+		{" 100m ", 0.1},
+	}
+
+	for _, test := range tests {
+		value, err := ParseQuantity(test.quantity)
+		if err != nil {
+			t.Errorf("ParseQuantity(%q) returned error: %v", test.quantity, err)
+		} else if value != test.value {
+			t.Errorf("ParseQuantity(%q) = %v, want %v", test.quantity, value, test.value)
+		}
+	}
+
+	for _, quantity := range []string{"", "abc", "1Xi", "1.2.3m"} {
+		if _, err := ParseQuantity(quantity); err == nil {
+			t.Errorf("ParseQuantity(%q) expected an error", quantity)
+		}
+	}
+
+}
+
+func TestFormatQuantity(t *testing.T) {
+
+	tests := []struct {
+		resource string
+		value    float64
+		quantity string
+	}{
+		{"cpu", 0.1, "100m"},
+		{"cpu", 0.9860000000000001, "986m"},
+		{"cpu", 0.25, "250m"},
+		{"cpu", 0.0001, "1m"},
+		{"cpu", 1.2345, "1235m"},
+		{"cpu", 3, "3000m"},
+		{"memory", 512 * (1 << 20), "512Mi"},
+		{"memory", 1000, "1000"},
+		{"memory", 999.2, "1000"},
+	}
+
+	for _, test := range tests {
+		if quantity := FormatQuantity(test.resource, test.value); quantity != test.quantity {
+			t.Errorf("FormatQuantity(%q, %v) = %q, want %q", test.resource, test.value, quantity, test.quantity)
+		}
+	}
+
+}
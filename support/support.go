@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/magiconair/properties"
 	"golang.org/x/crypto/ssh/terminal"
@@ -25,6 +26,17 @@ var KubectlBin = "kubectl"
 
 var secretNamespace string
 
+//InsightMeta holds the audit metadata reported by a repository alongside an insight
+type InsightMeta struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+	SeenCount int
+	DataDays  int
+
+	//Resolution holds the rules used to pick the insight when the repository returned several candidates
+	Resolution string
+}
+
 //LoadConfigMap loads the config map from the densify forwarder
 func LoadConfigMap() {
 
@@ -68,26 +80,29 @@ func CheckError(message string, err error, exit bool) bool {
 //LocateConfigNamespace will identify which namespace the configuration secret is stored.
 func LocateConfigNamespace(secretName string) {
 
+	//users without permission to list secrets across namespaces fall back to the helm namespace
+	secretNamespace = os.Getenv("HELM_NAMESPACE")
+
 	cmd := exec.Command(KubectlBin, "get", "secrets", "-o", "json", "--all-namespaces")
-	out, err := cmd.CombinedOutput()
+	out, err := cmd.Output()
 	if err != nil {
-		secretNamespace = ""
+		return
 	}
 
 	var secretsMapEncoded map[string]interface{}
 	json.Unmarshal(out, &secretsMapEncoded)
 
-	for _, val := range secretsMapEncoded["items"].([]interface{}) {
-		name := val.(map[string]interface{})["metadata"].(map[string]interface{})["name"]
-		if name == secretName {
-			secretNamespace = val.(map[string]interface{})["metadata"].(map[string]interface{})["namespace"].(string)
+	items, _ := secretsMapEncoded["items"].([]interface{})
+	for _, val := range items {
+		metadata, _ := val.(map[string]interface{})["metadata"].(map[string]interface{})
+		if metadata["name"] == secretName {
+			if namespace, ok := metadata["namespace"].(string); ok {
+				secretNamespace = namespace
+			}
 			return
 		}
-
 	}
 
-	secretNamespace = os.Getenv("HELM_NAMESPACE")
-
 }
 
 //DeleteSecret deletes the specified k8s secret
@@ -95,43 +110,35 @@ func DeleteSecret(secretName string) {
 	_, _, _ = ExecuteSingleCommand([]string{KubectlBin, "delete", "secret", secretName, "--namespace", secretNamespace, "--ignore-not-found"})
 }
 
-//RemoveSecretData deletes the specified k8s secret
+//RemoveSecretData removes a key of the active profile from the config store (the local config file or the k8s secret)
 func RemoveSecretData(secretName string, secretKey string) error {
-
-	secrets := RetrieveSecrets(secretName)
-	if _, ok := secrets[secretKey]; ok {
-		delete(secrets, secretKey)
-	}
-
-	DeleteSecret(secretName)
-	if StoreSecrets(secretName, secrets) {
-		return nil
-	} else {
-		return errors.New("failed to remove secret data")
-	}
-
+	return updateStore(secretName, nil, []string{scopedKey(secretKey)})
 }
 
-//StoreSecrets stores the specified k8s secret
+//StoreSecrets stores the specified keys of the active profile in the config store (the local config file or the k8s secret).
+//Keys resolved from a flag or environment variable override are never stored.
 func StoreSecrets(secretName string, secrets map[string]string) bool {
+	return UpdateSecrets(secretName, secrets, nil)
+}
 
-	existingSecrets := RetrieveSecrets(secretName)
-	if existingSecrets == nil {
-		existingSecrets = make(map[string]string)
-	}
+//UpdateSecrets stores the specified keys of the active profile and removes the stale keys in a single write of the config store.
+//Keys resolved from a flag or environment variable override are never stored.
+func UpdateSecrets(secretName string, secrets map[string]string, staleKeys []string) bool {
 
+	scoped := make(map[string]string)
 	for key, val := range secrets {
-		existingSecrets[key] = val
+		if !overridden(key) {
+			scoped[scopedKey(key)] = val
+		}
 	}
 
-	createCmd := []string{KubectlBin, "create", "secret", "generic", secretName, "--namespace", secretNamespace}
-	for key, val := range existingSecrets {
-		createCmd = append(createCmd, "--from-literal="+key+"="+val)
+	var remove []string
+	for _, key := range staleKeys {
+		remove = append(remove, scopedKey(key))
 	}
 
-	DeleteSecret(secretName)
-	_, _, err := ExecuteSingleCommand(createCmd)
-	if err != nil {
+	if err := updateStore(secretName, scoped, remove); err != nil {
+		fmt.Println(err)
 		return false
 	}
 
@@ -139,24 +146,120 @@ func StoreSecrets(secretName string, secrets map[string]string) bool {
 
 }
 
-//RetrieveSecrets will retreive the specified secret
+//RetrieveSecrets will retreive the effective configuration of the active profile (see ResolveConfig), nil if the plugin is not configured
 func RetrieveSecrets(secretName string) map[string]string {
 
-	stdOut, _, err := ExecuteSingleCommand([]string{KubectlBin, "get", "secret", secretName, "--namespace", secretNamespace, "-o", "jsonpath={.data}"})
-	if err != nil {
+	values, _ := ResolveConfig(secretName)
+	if len(values) == 0 {
 		return nil
 	}
 
-	var secretsMapEncoded map[string]string
-	json.Unmarshal([]byte(stdOut), &secretsMapEncoded)
+	return values
+
+}
+
+//readSecret reads the data of the k8s secret, nil if it can't be read
+func readSecret(secretName string) map[string]string {
+
+	secrets, _, _ := readSecretVersion(secretName)
+	return secrets
+
+}
+
+//readSecretVersion reads the data of the k8s secret along with its resourceVersion.  A missing secret is not an error, and returns no data.
+func readSecretVersion(secretName string) (map[string]string, string, error) {
+
+	stdOut, stdErr, err := ExecuteSingleCommand([]string{KubectlBin, "get", "secret", secretName, "--namespace", secretNamespace, "-o", "json"})
+	if err != nil {
+		if strings.Contains(stdErr, "NotFound") {
+			return nil, "", nil
+		}
+		return nil, "", errors.New("failed to read secret [" + secretName + "]: " + strings.TrimSpace(stdErr))
+	}
+
+	var secret struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(stdOut), &secret); err != nil {
+		return nil, "", errors.New("failed to read secret [" + secretName + "]: " + err.Error())
+	}
 
 	secretsMapDecoded := make(map[string]string)
-	for key, encodedVal := range secretsMapEncoded {
+	for key, encodedVal := range secret.Data {
 		decodedVal, _ := base64.StdEncoding.DecodeString(encodedVal)
 		secretsMapDecoded[key] = string(decodedVal)
 	}
 
-	return secretsMapDecoded
+	return secretsMapDecoded, secret.Metadata.ResourceVersion, nil
+
+}
+
+//writeSecret replaces the data of the k8s secret in place (or creates it when no resourceVersion was read), passing the manifest through stdin
+//so the values never appear in the process arguments.  The replace carries the resourceVersion read, so it fails if the secret changed since.
+func writeSecret(secretName string, secrets map[string]string, resourceVersion string) error {
+
+	data := make(map[string]string)
+	for key, val := range secrets {
+		data[key] = base64.StdEncoding.EncodeToString([]byte(val))
+	}
+
+	metadata := map[string]interface{}{
+		"name":   secretName,
+		"labels": map[string]string{"app.kubernetes.io/managed-by": "helm-optimize"},
+	}
+	if secretNamespace != "" {
+		metadata["namespace"] = secretNamespace
+	}
+	if resourceVersion != "" {
+		metadata["resourceVersion"] = resourceVersion
+	}
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata":   metadata,
+		"data":       data,
+	})
+	if err != nil {
+		return err
+	}
+
+	//replace is a single update of the existing secret, so a failure leaves the previous config intact
+	operation := "replace"
+	if resourceVersion == "" {
+		operation = "create"
+	}
+	_, stdErr, err := ExecuteCommandWithStdin([]string{KubectlBin, operation, "-f", "-", "--namespace", secretNamespace}, manifest)
+	if err != nil && (strings.Contains(stdErr, "Conflict") || strings.Contains(stdErr, "AlreadyExists") || strings.Contains(stdErr, "has been modified")) {
+		return errors.New("failed to store secret [" + secretName + "]: it was changed by another process, please try again")
+	}
+	if err != nil {
+		return errors.New("failed to store secret [" + secretName + "]: " + stdErr)
+	}
+
+	return nil
+
+}
+
+//ExecuteCommandWithStdin executes a given command, feeding the input through stdin.
+func ExecuteCommandWithStdin(command []string, input []byte) (string, string, error) {
+
+	if len(command) == 0 {
+		return "", "", errors.New("no command submitted")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	return strings.TrimSuffix(stdout.String(), "\n"), strings.TrimSuffix(stderr.String(), "\n"), err
 
 }
 
@@ -201,6 +304,22 @@ func ExecuteSingleCommand(command []string) (string, string, error) {
 
 }
 
+//ReadLine reads a line of user input (including spaces).  Stdin is read a byte at a time so input meant for later prompts is not consumed.
+func ReadLine() string {
+
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(b); n == 0 || err != nil || b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+
+	return strings.TrimSpace(string(line))
+
+}
+
 //FileExists will check if a file (not directory) exists in the specified path.
 func FileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -307,27 +426,167 @@ func DeleteFile(filepath string) error {
 //HTTPRequest send a REST api request to an end point
 func HTTPRequest(method string, endpoint string, authStr string, body []byte) (string, error) {
 
-	auth := base64.StdEncoding.EncodeToString([]byte(authStr))
-	req, _ := http.NewRequest(method, endpoint, bytes.NewBuffer(body))
-	req.Header.Add("Authorization", "Basic "+auth)
+	resp, _, err := HTTPRequestWithAuth(method, endpoint, "Basic "+base64.StdEncoding.EncodeToString([]byte(authStr)), body)
+	return resp, err
+
+}
+
+//HTTPRequestWithAuth send a REST api request to an end point using the given Authorization header, and returns the status code
+func HTTPRequestWithAuth(method string, endpoint string, authHeader string, body []byte) (string, int, error) {
+
+	req, err := http.NewRequest(method, endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return "", 0, err
+	}
+	if authHeader != "" {
+		req.Header.Add("Authorization", authHeader)
+	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	defer resp.Body.Close()
 	bodyBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", resp.StatusCode, err
 	}
 
 	if resp.StatusCode == 200 {
-		return string(bodyBytes), nil
+		return string(bodyBytes), resp.StatusCode, nil
+	}
+
+	return "", resp.StatusCode, errors.New(string(bodyBytes))
+
+}
+
+//Selector holds the requirements of a parsed k8s label selector
+type Selector []selectorRequirement
+
+type selectorRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+//ParseSelector parses and validates every requirement of a k8s label selector (eg. app=web,tier!=cache,env in (dev,qa),!legacy).
+func ParseSelector(selector string) (Selector, error) {
+
+	//split requirements on commas that are not within a set
+	var requirements []string
+	depth, start := 0, 0
+	for i, char := range selector {
+		switch char {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				requirements = append(requirements, selector[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 || depth > 1 {
+			return nil, errors.New("invalid selector [" + selector + "] - unbalanced parentheses")
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("invalid selector [" + selector + "] - unbalanced parentheses")
+	}
+	requirements = append(requirements, selector[start:])
+
+	var parsed Selector
+	for _, requirement := range requirements {
+
+		requirement = strings.TrimSpace(requirement)
+		if requirement == "" {
+			continue
+		}
+
+		var req selectorRequirement
+		if fields := strings.Fields(requirement); len(fields) >= 3 && (fields[1] == "in" || fields[1] == "notin") {
+			set := strings.TrimSpace(strings.Join(fields[2:], " "))
+			if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+				return nil, errors.New("invalid selector requirement [" + requirement + "]")
+			}
+			req = selectorRequirement{key: fields[0], operator: fields[1]}
+			for _, value := range strings.Split(set[1:len(set)-1], ",") {
+				req.values = append(req.values, strings.TrimSpace(value))
+			}
+		} else if idx := strings.Index(requirement, "!="); idx > 0 {
+			req = selectorRequirement{key: requirement[:idx], operator: "!=", values: []string{requirement[idx+2:]}}
+		} else if idx := strings.Index(requirement, "=="); idx > 0 {
+			req = selectorRequirement{key: requirement[:idx], operator: "=", values: []string{requirement[idx+2:]}}
+		} else if idx := strings.Index(requirement, "="); idx > 0 {
+			req = selectorRequirement{key: requirement[:idx], operator: "=", values: []string{requirement[idx+1:]}}
+		} else if strings.HasPrefix(requirement, "!") {
+			req = selectorRequirement{key: requirement[1:], operator: "!"}
+		} else {
+			req = selectorRequirement{key: requirement, operator: "exists"}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		for i := range req.values {
+			req.values[i] = strings.TrimSpace(req.values[i])
+		}
+		if req.key == "" || strings.ContainsAny(req.key, " =!()") {
+			return nil, errors.New("invalid selector requirement [" + requirement + "]")
+		}
+		for _, value := range req.values {
+			if strings.ContainsAny(value, " =!()") {
+				return nil, errors.New("invalid selector requirement [" + requirement + "]")
+			}
+		}
+		parsed = append(parsed, req)
+
+	}
+
+	return parsed, nil
+
+}
+
+//Matches checks whether the labels satisfy every requirement of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+
+	for _, req := range s {
+
+		val, exists := labels[req.key]
+		_, found := InSlice(req.values, val)
+
+		var matched bool
+		switch req.operator {
+		case "in", "=":
+			matched = exists && found
+		case "notin", "!=":
+			matched = !(exists && found)
+		case "!":
+			matched = !exists
+		case "exists":
+			matched = exists
+		}
+
+		if !matched {
+			return false
+		}
+
+	}
+
+	return true
+
+}
+
+//MatchSelector checks whether the labels satisfy a k8s label selector (eg. app=web,tier!=cache,env in (dev,qa),!legacy).
+func MatchSelector(selector string, labels map[string]string) (bool, error) {
+
+	parsed, err := ParseSelector(selector)
+	if err != nil {
+		return false, err
 	}
 
-	return "", errors.New(string(bodyBytes))
+	return parsed.Matches(labels), nil
 
 }
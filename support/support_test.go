@@ -0,0 +1,115 @@
+package support
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//TestWriteSecret updates the config secret through a fake kubectl that records its arguments and stdin
+func TestWriteSecret(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "helm-optimize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//get prints the secret (or the error) held in the directory, replace and create fail with the error held in the directory
+	script := "#!/bin/sh\necho \"$@\" >> " + dir + "/argv\n" +
+		"case \"$1\" in\n" +
+		"get) if [ -f " + dir + "/get-error ]; then cat " + dir + "/get-error >&2; exit 1; fi; cat " + dir + "/secret.json;;\n" +
+		"*) cat > " + dir + "/stdin; if [ -f " + dir + "/write-error ]; then cat " + dir + "/write-error >&2; exit 1; fi;;\n" +
+		"esac\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	originalStore, originalKubectl, originalNamespace := ConfigStore, KubectlBin, secretNamespace
+	ConfigStore, KubectlBin, secretNamespace = "secret", filepath.Join(dir, "kubectl"), "ns"
+	defer func() {
+		ConfigStore, KubectlBin, secretNamespace = originalStore, originalKubectl, originalNamespace
+	}()
+
+	existing := `{"metadata":{"name":"helm-optimize-plugin","resourceVersion":"42"},"data":{"adapter":"RGVuc2lmeQ=="}}`
+	notFound := `Error from server (NotFound): secrets "helm-optimize-plugin" not found`
+
+	tests := []struct {
+		name            string
+		getError        string
+		writeError      string
+		operation       string
+		resourceVersion string
+		data            map[string]string
+		err             string
+	}{
+		{"missing secret", notFound, "", "create", "", map[string]string{"densifyAPIKey": "top-secret"}, ""},
+		{"existing secret", "", "", "replace", "42", map[string]string{"adapter": "Densify", "densifyAPIKey": "top-secret"}, ""},
+		{"changed since read", "", "Error from server (Conflict): the object has been modified", "replace", "42", nil, "it was changed by another process"},
+		{"unreadable secret", "Error from server (Forbidden): secrets is forbidden", "", "", "", nil, "failed to read secret"},
+	}
+
+	for _, test := range tests {
+
+		os.Remove(filepath.Join(dir, "argv"))
+		os.Remove(filepath.Join(dir, "stdin"))
+		ioutil.WriteFile(filepath.Join(dir, "secret.json"), []byte(existing), 0600)
+		os.Remove(filepath.Join(dir, "get-error"))
+		os.Remove(filepath.Join(dir, "write-error"))
+		if test.getError != "" {
+			ioutil.WriteFile(filepath.Join(dir, "get-error"), []byte(test.getError), 0600)
+		}
+		if test.writeError != "" {
+			ioutil.WriteFile(filepath.Join(dir, "write-error"), []byte(test.writeError), 0600)
+		}
+
+		err := updateStore("helm-optimize-plugin", map[string]string{"densifyAPIKey": "top-secret"}, nil)
+		if (test.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: updateStore error = %v, want %s", test.name, err, test.err)
+		}
+
+		argv, _ := ioutil.ReadFile(filepath.Join(dir, "argv"))
+		if strings.Contains(string(argv), "top-secret") || strings.Contains(string(argv), "dG9wLXNlY3JldA==") {
+			t.Errorf("%s: secret value passed as an argument: %s", test.name, argv)
+		}
+		lines := strings.Split(strings.TrimSpace(string(argv)), "\n")
+		if test.operation == "" {
+			if len(lines) != 1 {
+				t.Errorf("%s: kubectl called with %v, want only the read", test.name, lines)
+			}
+			continue
+		}
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], test.operation+" -f -") {
+			t.Errorf("%s: kubectl called with %v, want a %s", test.name, lines, test.operation)
+			continue
+		}
+
+		var manifest struct {
+			Metadata map[string]interface{}
+			Data     map[string]string
+		}
+		stdin, _ := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+		if err := json.Unmarshal(stdin, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if version, _ := manifest.Metadata["resourceVersion"].(string); version != test.resourceVersion {
+			t.Errorf("%s: resourceVersion = [%s], want [%s]", test.name, version, test.resourceVersion)
+		}
+		if test.data != nil {
+			decoded := make(map[string]string)
+			for key, val := range manifest.Data {
+				decodedVal, _ := base64.StdEncoding.DecodeString(val)
+				decoded[key] = string(decodedVal)
+			}
+			if len(decoded) != len(test.data) || decoded["densifyAPIKey"] != test.data["densifyAPIKey"] || decoded["adapter"] != test.data["adapter"] {
+				t.Errorf("%s: data = %v, want %v", test.name, decoded, test.data)
+			}
+		}
+
+	}
+
+}